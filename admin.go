@@ -0,0 +1,143 @@
+package main
+
+import (
+	js "encoding/json"
+	"errors"
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"github.com/OpenDriversLog/odl-geocoder/utils"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+)
+
+// max size of the body of admin requests
+const maxAdminBodySize = 1024 * 1024
+
+// addAdminRoutes adds the routes to see the status of & manage the providers at runtime - the geocoder saves changes to
+// its ProvidersFile. Api keys of the providers are never shown.
+func addAdminRoutes() {
+	handle := func(method string, path string, h func(r *http.Request, ps httprouter.Params) (interface{}, error)) {
+		router.Handle(method, path, authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			defer func() {
+				if err := recover(); err != nil {
+					dbg.E(TAG, "panic in admin: %v for request : %v", err, dbg.GetRequest(r))
+					http.Error(w, http.StatusText(500), 500)
+				}
+			}()
+			res, err := h(r, ps)
+			writeAdminResult(w, res, err)
+		}, true))
+	}
+	handle("GET", "/status", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return geocoder.Status(), nil
+	})
+	handle("GET", "/admin/providers", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return redactedProviders(), nil
+	})
+	handle("GET", "/admin/providers/:name", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return providerAfter(ps.ByName("name"), nil)
+	})
+	handle("POST", "/admin/providers", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		p, err := readProvider(r)
+		if err == nil {
+			err = geocoder.AddProvider(p)
+		}
+		return providerAfter(p.Name, err)
+	})
+	handle("PUT", "/admin/providers/:name", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		p, err := readProvider(r)
+		if err == nil {
+			err = geocoder.UpdateProvider(ps.ByName("name"), p)
+		}
+		if p.Name == "" {
+			p.Name = ps.ByName("name")
+		}
+		return providerAfter(p.Name, err)
+	})
+	handle("DELETE", "/admin/providers/:name", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		err := geocoder.RemoveProvider(ps.ByName("name"))
+		if err != nil {
+			return nil, err
+		}
+		return redactedProviders(), nil
+	})
+	handle("POST", "/admin/providers/:name/enable", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return providerAfter(ps.ByName("name"), geocoder.SetProviderDisabled(ps.ByName("name"), false))
+	})
+	handle("POST", "/admin/providers/:name/disable", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return providerAfter(ps.ByName("name"), geocoder.SetProviderDisabled(ps.ByName("name"), true))
+	})
+	handle("POST", "/admin/providers/:name/reset", func(r *http.Request, ps httprouter.Params) (interface{}, error) {
+		return providerAfter(ps.ByName("name"), geocoder.ResetProviderCounts(ps.ByName("name")))
+	})
+}
+
+// providerAfter returns the provider with the given name after a change - or err, if the change failed.
+func providerAfter(name string, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	p, err := geocoder.Provider(name)
+	if err != nil {
+		return nil, err
+	}
+	return utils.RedactKeys(p), nil
+}
+
+// redactedProviders returns all providers without their api keys.
+func redactedProviders() []models.GeoCodeProvider {
+	provs := geocoder.Providers()
+	for i := range provs {
+		provs[i] = utils.RedactKeys(provs[i])
+	}
+	return provs
+}
+
+// readProvider reads a models.GeoCodeProvider from the json body.
+func readProvider(r *http.Request) (p models.GeoCodeProvider, err error) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxAdminBodySize))
+	if err == nil {
+		err = js.Unmarshal(b, &p)
+	}
+	if err != nil {
+		dbg.W(TAG, "Could not parse provider : ", err)
+		err = errBadRequest
+	}
+	return
+}
+
+type adminError struct {
+	Error string
+}
+
+var errBadRequest = errors.New("Provider not parsable")
+
+// writeAdminResult writes res as json - or err with a matching status code.
+func writeAdminResult(w http.ResponseWriter, res interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	status := 200
+	switch err {
+	case nil:
+	case utils.ErrProviderNotFound:
+		status = 404
+	case utils.ErrProviderExists:
+		status = 409
+	case utils.ErrProviderNameMissing, errBadRequest:
+		status = 400
+	default:
+		dbg.E(TAG, "Error changing providers : ", err)
+		status = 500
+	}
+	if err != nil {
+		res = adminError{Error: err.Error()}
+	}
+	b, err := js.Marshal(res)
+	if err != nil {
+		dbg.E(TAG, "Error marshaling : ", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
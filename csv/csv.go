@@ -0,0 +1,154 @@
+// Package csv forward geocodes the rows of csv files.
+package csv
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/odl-geocoder/utils"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const TAG = "ogc/csv.go"
+
+var ErrNoAddressColumn = errors.New("No address column configured")
+var ErrColumnNotFound = errors.New("Column not found")
+var ErrTooManyRows = errors.New("Too many rows")
+
+// ResultColumns are appended to every row of the csv.
+var ResultColumns = []string{"lat", "lng", "street", "houseNumber", "postal", "city", "country", "provider", "error"}
+
+// Columns tells which columns contain the address - either Address or some of Street, HouseNumber, Postal, City
+// & Country. Columns are given by their name in the header or by their index, starting with 0.
+type Columns struct {
+	Address     string
+	Street      string
+	HouseNumber string
+	Postal      string
+	City        string
+	Country     string
+}
+
+// columnIdx returns the index of the column named col - or col itself, if it is a number. -1 means not configured.
+func columnIdx(header []string, col string) (int, error) {
+	if col == "" {
+		return -1, nil
+	}
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), col) {
+			return i, nil
+		}
+	}
+	i, err := strconv.Atoi(col)
+	if err != nil || i < 0 || i >= len(header) {
+		return -1, ErrColumnNotFound
+	}
+	return i, nil
+}
+
+func field(row []string, idx int) string {
+	if idx < 0 || idx >= len(row) {
+		return ""
+	}
+	return row[idx]
+}
+
+// GeoCodeCsv forward geocodes every row of the csv in r (the first row is the header) and writes it to w, with
+// ResultColumns appended. Errors of single rows are reported in their error column. maxRows = 0 means no limit.
+func GeoCodeCsv(ctx context.Context, g *utils.Geocoder, r io.Reader, w io.Writer, cols Columns, maxRows int, dontChain bool, uId string) (err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		dbg.W(TAG, "Could not parse csv : ", err)
+		return
+	}
+	if len(rows) == 0 {
+		return ErrColumnNotFound
+	}
+	header, rows := rows[0], rows[1:]
+	if maxRows > 0 && len(rows) > maxRows {
+		return ErrTooManyRows
+	}
+	var idx [6]int
+	for i, col := range []string{cols.Address, cols.Street, cols.HouseNumber, cols.Postal, cols.City, cols.Country} {
+		idx[i], err = columnIdx(header, col)
+		if err != nil {
+			dbg.W(TAG, "Could not find column "+col+" : ", err)
+			return
+		}
+	}
+	if idx == [6]int{-1, -1, -1, -1, -1, -1} {
+		return ErrNoAddressColumn
+	}
+
+	opts := utils.RequestOptions{UserId: uId, DontChain: dontChain}
+	var results []utils.BatchResult
+	if idx[0] >= 0 {
+		addresses := make([]string, len(rows))
+		for i, row := range rows {
+			addresses[i] = strings.TrimSpace(field(row, idx[0]))
+		}
+		results = g.ForwardBatch(ctx, addresses, opts)
+	} else {
+		addresses := make([]utils.StructuredAddress, len(rows))
+		for i, row := range rows {
+			addresses[i] = utils.StructuredAddress{
+				Street:      strings.TrimSpace(field(row, idx[1])),
+				HouseNumber: strings.TrimSpace(field(row, idx[2])),
+				Postal:      strings.TrimSpace(field(row, idx[3])),
+				City:        strings.TrimSpace(field(row, idx[4])),
+				Country:     strings.TrimSpace(field(row, idx[5])),
+			}
+		}
+		results = g.ForwardStructuredBatch(ctx, addresses, opts)
+	}
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(append(append([]string{}, header...), ResultColumns...))
+	if err != nil {
+		return
+	}
+	for i, row := range rows {
+		err = cw.Write(append(append([]string{}, row...), resultFields(results[i])...))
+		if err != nil {
+			return
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// resultFields returns the values of ResultColumns for a single result.
+func resultFields(r utils.BatchResult) []string {
+	if r.Err == utils.ErrEmptyResult {
+		return []string{"", "", "", "", "", "", "", r.Provider, "No result found"}
+	} else if r.Err != nil {
+		return []string{"", "", "", "", "", "", "", "", errorMessage(r.Err)}
+	}
+	a := r.Address
+	return []string{
+		strconv.FormatFloat(a.Lat, 'f', -1, 64),
+		strconv.FormatFloat(a.Lng, 'f', -1, 64),
+		a.Street, a.HouseNumber, a.Postal, a.City, a.Country,
+		r.Provider, "",
+	}
+}
+
+func errorMessage(err error) string {
+	switch err {
+	case utils.ErrNoRequestsLeft:
+		return "No working geocoders left :("
+	case utils.ErrPlanLimitReached:
+		return "Request limit of your plan reached"
+	case utils.ErrEmptyQuery:
+		return err.Error()
+	case context.Canceled, context.DeadlineExceeded:
+		return "Cancelled"
+	}
+	dbg.E(TAG, "Error geocoding : ", err)
+	return "Error geocoding"
+}
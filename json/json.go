@@ -1,6 +1,7 @@
 package json
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/Compufreak345/dbg"
 	"github.com/OpenDriversLog/odl-geocoder/models"
@@ -10,7 +11,7 @@ import (
 
 const TAG = "ogc/json.go"
 
-func GetJsonReverseGeoCode(sLat string, sLng string, reqId string, dontChain bool, uId string) (output []byte, err error) {
+func GetJsonReverseGeoCode(ctx context.Context, g *utils.Geocoder, sLat string, sLng string, reqId string, dontChain bool, uId string) (output []byte, err error) {
 	var res models.GeoResp
 	if sLat == "" || sLng == "" {
 		output, err = json.Marshal(GetErrorGeoCodeResponse("No lat/lng provided", reqId))
@@ -26,30 +27,8 @@ func GetJsonReverseGeoCode(sLat string, sLng string, reqId string, dontChain boo
 			output, err = json.Marshal(GetErrorGeoCodeResponse("Longitude not parsable", reqId))
 			return
 		}
-		add, prov, _err := utils.ReverseGeocode(lat, lng, dontChain, uId)
-		if _err != nil {
-			if _err == utils.ErrNoRequestsLeft {
-				dbg.W(TAG, "No requests left :(")
-				output, err = json.Marshal(GetErrorGeoCodeResponse("No working geocoders left :(", reqId))
-				return
-
-			} else if _err == utils.ErrEmptyResult {
-				dbg.W(TAG,"No geocoding result found...")
-			} else {
-				dbg.E(TAG, "Error reverse geocoding : ", _err)
-				output, err = json.Marshal(GetErrorGeoCodeResponse("Error reversing", reqId))
-				return
-			}
-		}
-		res.Address = add
-		res.ReqId = reqId
-		res.CurUserRequestsUsed = utils.CurRequestsByUserUsed[uId]
-		res.CurDailyRequestsUsed = utils.CurDailyRequestsUsed
-		res.MaxRequestsPerUser = utils.MaxRequestsPerUser
-		res.MaxRequestsPerDay = utils.MaxRequestsPerDay
-		if prov!=nil {
-			res.Provider = prov.Name
-		}
+		r, _err := g.Reverse(ctx, lat, lng, utils.RequestOptions{UserId: uId, DontChain: dontChain})
+		res = GetGeoCodeResponse(g, r, _err, reqId, uId)
 	}
 	output, err = json.Marshal(res)
 	if err != nil {
@@ -58,36 +37,125 @@ func GetJsonReverseGeoCode(sLat string, sLng string, reqId string, dontChain boo
 	return
 }
 
-func GetJsonGeoCode(s string, reqId string, dontChain bool, uId string) (output []byte, err error) {
+// GetJsonGeoCode forward geocodes s for opts.UserId and returns the json models.GeoResp.
+func GetJsonGeoCode(ctx context.Context, g *utils.Geocoder, s string, reqId string, opts utils.RequestOptions) (output []byte, err error) {
 	var res models.GeoResp
 	if s == "" {
 		output, err = json.Marshal(GetErrorGeoCodeResponse("No address provided", reqId))
 		return
 	}
 
-	add, prov, _err := utils.Geocode(s, dontChain, uId)
-	if _err != nil {
-		if _err == utils.ErrNoRequestsLeft {
-			dbg.W(TAG, "No requests left :(")
-			output, err = json.Marshal(GetErrorGeoCodeResponse("No working geocoders left :(", reqId))
-			return
-		} else if _err == utils.ErrEmptyResult {
-			dbg.W(TAG,"No geocoding result found...")
-			err = nil
+	r, _err := g.Forward(ctx, s, opts)
+	res = GetGeoCodeResponse(g, r, _err, reqId, opts.UserId)
+	output, err = json.Marshal(res)
+	if err != nil {
+		dbg.E(TAG, "Error marshaling : ", err)
+	}
+	return
+}
+
+// GetJsonReverseBatch reverse geocodes a json array of models.ReverseBatchItem and returns a json array of
+// models.GeoResp in the same order. Errors of single items are reported in their GeoResp.
+func GetJsonReverseBatch(ctx context.Context, g *utils.Geocoder, body []byte, maxItems int, dontChain bool, uId string) (output []byte, err error) {
+	var items []models.ReverseBatchItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		dbg.W(TAG, "Could not parse reverse batch : ", err)
+		output, err = json.Marshal([]models.GeoResp{GetErrorGeoCodeResponse("Batch not parsable", "")})
+		return
+	}
+	if maxItems > 0 && len(items) > maxItems {
+		output, err = json.Marshal([]models.GeoResp{GetErrorGeoCodeResponse("Batch too big, max "+strconv.Itoa(maxItems)+" items allowed", "")})
+		return
+	}
+	points := make([]utils.BatchPoint, len(items))
+	for i, v := range items {
+		points[i] = utils.BatchPoint{Lat: v.Lat, Lng: v.Lng}
+	}
+	results := g.ReverseBatch(ctx, points, utils.RequestOptions{UserId: uId, DontChain: dontChain})
+	res := make([]models.GeoResp, len(results))
+	for i, r := range results {
+		res[i] = GetGeoCodeResponse(g, r.Result, r.Err, items[i].ReqId, uId)
+	}
+	output, err = json.Marshal(res)
+	if err != nil {
+		dbg.E(TAG, "Error marshaling : ", err)
+	}
+	return
+}
+
+// GetJsonForwardBatch forward geocodes a json array of models.ForwardBatchItem and returns a json array of
+// models.GeoResp in the same order. Errors of single items are reported in their GeoResp.
+func GetJsonForwardBatch(ctx context.Context, g *utils.Geocoder, body []byte, maxItems int, dontChain bool, uId string) (output []byte, err error) {
+	var items []models.ForwardBatchItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		dbg.W(TAG, "Could not parse forward batch : ", err)
+		output, err = json.Marshal([]models.GeoResp{GetErrorGeoCodeResponse("Batch not parsable", "")})
+		return
+	}
+	if maxItems > 0 && len(items) > maxItems {
+		output, err = json.Marshal([]models.GeoResp{GetErrorGeoCodeResponse("Batch too big, max "+strconv.Itoa(maxItems)+" items allowed", "")})
+		return
+	}
+	// items with an address are looked up as is, the ones given in parts with a structured search
+	var addresses []string
+	var structured []utils.StructuredAddress
+	var addressIdx, structuredIdx []int
+	for i, v := range items {
+		if v.Address != "" {
+			addresses = append(addresses, v.Address)
+			addressIdx = append(addressIdx, i)
 		} else {
-			dbg.E(TAG, "Error forward geocoding : ", _err)
-			output, err = json.Marshal(GetErrorGeoCodeResponse("Error reversing", reqId))
-			return
+			structured = append(structured, utils.StructuredAddress{Street: v.Street, HouseNumber: v.HouseNumber, Postal: v.Postal, City: v.City, Country: v.Country})
+			structuredIdx = append(structuredIdx, i)
 		}
 	}
-	res.Address = add
+	opts := utils.RequestOptions{UserId: uId, DontChain: dontChain}
+	results := make([]utils.BatchResult, len(items))
+	for i, r := range g.ForwardBatch(ctx, addresses, opts) {
+		results[addressIdx[i]] = r
+	}
+	for i, r := range g.ForwardStructuredBatch(ctx, structured, opts) {
+		results[structuredIdx[i]] = r
+	}
+	res := make([]models.GeoResp, len(results))
+	for i, r := range results {
+		res[i] = GetGeoCodeResponse(g, r.Result, r.Err, items[i].ReqId, uId)
+	}
+	output, err = json.Marshal(res)
+	if err != nil {
+		dbg.E(TAG, "Error marshaling : ", err)
+	}
+	return
+}
+
+// GetJsonTrackStops detects the stops of a GPX or GeoJSON track and returns them reverse geocoded as json
+// models.TrackResp.
+func GetJsonTrackStops(ctx context.Context, g *utils.Geocoder, body []byte, stopOpts utils.StopOptions, reqId string, dontChain bool, uId string) (output []byte, err error) {
+	var res models.TrackResp
 	res.ReqId = reqId
-	res.CurUserRequestsUsed = utils.CurRequestsByUserUsed[uId]
-	res.CurDailyRequestsUsed = utils.CurDailyRequestsUsed
-	res.MaxRequestsPerUser = utils.MaxRequestsPerUser
-	res.MaxRequestsPerDay = utils.MaxRequestsPerDay
-	if prov!=nil {
-		res.Provider = prov.Name
+	points, _err := utils.ParseTrack(body)
+	if _err != nil {
+		dbg.W(TAG, "Could not parse track : ", _err)
+		res.Error = "Track not parsable : " + _err.Error()
+	} else {
+		stops := g.ReverseTrack(ctx, points, stopOpts, utils.RequestOptions{UserId: uId, DontChain: dontChain})
+		res.Stops = make([]models.TrackStop, len(stops))
+		for i, s := range stops {
+			r := GetGeoCodeResponse(g, s.Result, s.Err, "", uId)
+			res.Stops[i] = models.TrackStop{
+				Lat:       s.Lat,
+				Lng:       s.Lng,
+				Arrival:   s.Arrival,
+				Departure: s.Departure,
+				Address:   r.Address,
+				Provider:  r.Provider,
+				FromCache: r.FromCache,
+				Error:     r.Error,
+			}
+		}
+		res.MaxRequestsPerDay, res.MaxRequestsPerUser, res.CurDailyRequestsUsed, res.CurUserRequestsUsed = g.RequestCounts(uId)
 	}
 	output, err = json.Marshal(res)
 	if err != nil {
@@ -96,6 +164,124 @@ func GetJsonGeoCode(s string, reqId string, dontChain bool, uId string) (output
 	return
 }
 
+// GetJsonSubmitJob adds a job for the json array of models.ReverseBatchItem (jobType utils.JobReverse) or
+// models.ForwardBatchItem (utils.JobForward) to the queue and returns its id as json models.JobResp.
+func GetJsonSubmitJob(q *utils.JobQueue, body []byte, jobType string, dontChain bool, uId string) (output []byte, err error) {
+	job := utils.Job{Type: jobType, UserId: uId, DontChain: dontChain}
+	switch jobType {
+	case utils.JobReverse:
+		var items []models.ReverseBatchItem
+		err = json.Unmarshal(body, &items)
+		for _, v := range items {
+			job.Items = append(job.Items, utils.JobItem{ReqId: v.ReqId, Lat: v.Lat, Lng: v.Lng})
+		}
+	case utils.JobForward:
+		var items []models.ForwardBatchItem
+		err = json.Unmarshal(body, &items)
+		for _, v := range items {
+			it := utils.JobItem{ReqId: v.ReqId, Address: v.Address}
+			if v.Address == "" {
+				// keep the parts, so providers with a structured search can use them
+				it.Structured = &utils.StructuredAddress{Street: v.Street, HouseNumber: v.HouseNumber, Postal: v.Postal, City: v.City, Country: v.Country}
+			}
+			job.Items = append(job.Items, it)
+		}
+	}
+	if err != nil {
+		dbg.W(TAG, "Could not parse job : ", err)
+		return json.Marshal(models.JobResp{Error: "Job not parsable"})
+	}
+	id, _err := q.Submit(job)
+	if _err != nil {
+		dbg.W(TAG, "Could not submit job : ", _err)
+		return json.Marshal(models.JobResp{Error: _err.Error()})
+	}
+	return GetJsonJob(q, id, uId)
+}
+
+// GetJsonJob returns the progress & the results so far of the job of the given user as json models.JobResp.
+func GetJsonJob(q *utils.JobQueue, id string, uId string) (output []byte, err error) {
+	job, _err := q.Get(id)
+	if _err != nil || job.UserId != uId {
+		return json.Marshal(models.JobResp{Id: id, Error: utils.ErrJobNotFound.Error()})
+	}
+	res := models.JobResp{
+		Id:           job.Id,
+		Type:         job.Type,
+		Status:       job.Status,
+		Created:      job.Created,
+		Updated:      job.Updated,
+		WaitingUntil: job.WaitingUntil,
+		Total:        job.Total,
+		Done:         job.Done,
+		Results:      make([]models.GeoResp, 0, job.Done),
+	}
+	for _, it := range job.Items {
+		if !it.Done || it.Result == nil {
+			continue
+		}
+		res.Results = append(res.Results, models.GeoResp{
+			ReqId:         it.ReqId,
+			Address:       it.Result.Address,
+			Provider:      it.Result.Provider,
+			FromCache:     it.Result.FromCache,
+			CacheDistance: it.Result.Distance,
+			NoCache:       it.Result.NoCache,
+			Error:         it.Result.Error,
+		})
+	}
+	output, err = json.Marshal(res)
+	if err != nil {
+		dbg.E(TAG, "Error marshaling : ", err)
+	}
+	return
+}
+
+// GetJsonCancelJob cancels the job of the given user and returns it as json models.JobResp.
+func GetJsonCancelJob(q *utils.JobQueue, id string, uId string) (output []byte, err error) {
+	job, _err := q.Get(id)
+	if _err == nil && job.UserId == uId {
+		_err = q.Cancel(id)
+	}
+	if _err != nil || job.UserId != uId {
+		return json.Marshal(models.JobResp{Id: id, Error: utils.ErrJobNotFound.Error()})
+	}
+	return GetJsonJob(q, id, uId)
+}
+
+// GetGeoCodeResponse returns the response for the result of a single Geocoder lookup.
+func GetGeoCodeResponse(g *utils.Geocoder, r utils.Result, _err error, reqId string, uId string) (res models.GeoResp) {
+	if _err != nil {
+		if _err == utils.ErrNoRequestsLeft {
+			dbg.W(TAG, "No requests left :(")
+			return GetErrorGeoCodeResponse("No working geocoders left :(", reqId)
+		} else if _err == utils.ErrPlanLimitReached {
+			dbg.W(TAG, "Plan limit of user %s reached", uId)
+			return GetErrorGeoCodeResponse("Request limit of your plan reached", reqId)
+		} else if _err == context.DeadlineExceeded {
+			dbg.W(TAG, "Request of user %s timed out", uId)
+			return GetErrorGeoCodeResponse("Request timed out", reqId)
+		} else if _err == context.Canceled {
+			return GetErrorGeoCodeResponse("Request cancelled", reqId)
+		} else if _err == utils.ErrEmptyQuery {
+			return GetErrorGeoCodeResponse("No address provided", reqId)
+		} else if _err == utils.ErrEmptyResult {
+			dbg.W(TAG, "No geocoding result found...")
+		} else {
+			dbg.E(TAG, "Error geocoding : ", _err)
+			return GetErrorGeoCodeResponse("Error reversing", reqId)
+		}
+	}
+	res.Address = r.Address
+	res.ReqId = reqId
+	res.MaxRequestsPerDay, res.MaxRequestsPerUser, res.CurDailyRequestsUsed, res.CurUserRequestsUsed = g.RequestCounts(uId)
+	res.Provider = r.Provider
+	res.FromCache = r.FromCache
+	res.CacheDistance = r.Distance
+	res.NoCache = r.NoCache
+	return
+}
+
 func GetErrorGeoCodeResponse(msg string, reqId string) (res models.GeoResp) {
 	res = models.GeoResp{
 		ReqId: reqId,
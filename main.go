@@ -2,23 +2,47 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"github.com/Compufreak345/dbg"
 	"github.com/Compufreak345/manners"
 	"github.com/julienschmidt/httprouter"
+	"github.com/OpenDriversLog/odl-geocoder/csv"
 	"github.com/OpenDriversLog/odl-geocoder/json"
+	"github.com/OpenDriversLog/odl-geocoder/metrics"
+	"github.com/OpenDriversLog/odl-geocoder/models"
 	"github.com/OpenDriversLog/odl-geocoder/utils"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 	"net/url"
 	js "encoding/json"
 )
 
 var router = httprouter.New()
+var geocoder *utils.Geocoder
+var jobs *utils.JobQueue
+var keyStore *utils.KeyStore // nil if authentication is disabled
+var adminSecret string       // admin key if authentication is disabled - empty = admin routes can not be used then
+var maxBatchSize int
+
+// how long geocoding a request may take by default & at most, as set with the query parameter timeout
+var defaultTimeout time.Duration
+var maxTimeout time.Duration
+
+// max size of the body of batch requests
+const maxBatchBodySize = 10 * 1024 * 1024
+
+// max size of the body of job requests
+const maxJobBodySize = 200 * 1024 * 1024
 
 const TAG = "GC"
 
@@ -26,9 +50,91 @@ func main() {
 	var err error
 	port := flag.Int("port", 6091, "Port for the server to listen")
 	debug := flag.Bool("debug", false, "Debug mode enabled")
+	providersFile := flag.String("providers", "Providers.json", "File containing the providers to chain")
+	stateFile := flag.String("state", "AutoSavedProviders.json", "File the request counts of the providers are saved to")
+	plansFile := flag.String("plans", "Plans.json", "File containing the plans & which user has which plan, optional")
+	planUsageFile := flag.String("planusage", "AutoSavedPlanUsage.json", "File the requests per user & plan are saved to")
+	cacheSize := flag.Int("cachesize", 10000, "Max number of addresses kept in the result cache, 0 to disable")
+	cachePrecision := flag.Float64("cacheprecision", 10, "Precision in metres coordinates are rounded to for the result cache")
+	cacheTTL := flag.Duration("cachettl", 30*24*time.Hour, "How long cached addresses are used, 0 for forever")
+	cacheFile := flag.String("cachefile", "AutoSavedCache.db", "File resolved addresses are persisted to, empty to disable")
+	cacheFileMaxEntries := flag.Int("cachefilemaxentries", 1000000, "Max number of addresses kept in the cache file, 0 for no limit")
+	nearbyRadius := flag.Float64("nearbyradius", 25, "Radius in metres a cached address is used for reverse lookups, 0 to disable")
+	maxBatch := flag.Int("maxbatch", 1000, "Max number of items in a batch request")
+	jobsDir := flag.String("jobs", "AutoSavedJobs", "Directory the background jobs are saved to, one file per job")
+	maxJobSize := flag.Int("maxjob", 1000000, "Max number of items in a background job")
+	jobTTL := flag.Duration("jobttl", 7*24*time.Hour, "How long finished jobs are kept, 0 for forever")
+	keysFile := flag.String("keys", "ApiKeys.json", "File the hashed API keys are stored in")
+	noAuth := flag.Bool("noauth", false, "Don't check API keys - anyone who can reach the server can use it")
+	adminSecretFlag := flag.String("adminsecret", "", "Admin key for /status, /reparseChain & /admin if -noauth is set - without it these routes always answer 401")
+	addKey := flag.String("addkey", "", "Create an API key for the given user id, print it & exit")
+	enableMetrics := flag.Bool("metrics", true, "Serve prometheus metrics on /metrics")
+	timeout := flag.Duration("timeout", 30*time.Second, "Default time a request may take, 0 for no limit - clients can set their own with the query parameter timeout")
+	maxTimeoutFlag := flag.Duration("maxtimeout", 10*time.Minute, "Max time a request may take, 0 for no limit")
+	keyType := flag.String("keytype", "user", "Type of the key created with -addkey : user, admin or chain (for chaining odl-geocoders)")
 
 	flag.Parse()
 	utils.Debug = *debug
+	maxBatchSize = *maxBatch
+	defaultTimeout = *timeout
+	maxTimeout = *maxTimeoutFlag
+	if *addKey != "" {
+		ks, err := utils.OpenKeyStore(*keysFile)
+		if err != nil {
+			dbg.E(TAG, "Error loading API keys : ", err)
+			os.Exit(1)
+		}
+		key, err := ks.AddKey(utils.ApiKey{UserId: *addKey, Admin: *keyType == "admin", Chain: *keyType == "chain"})
+		if err != nil {
+			dbg.E(TAG, "Error adding API key : ", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+	if !*noAuth {
+		keyStore, err = utils.OpenKeyStore(*keysFile)
+		if err != nil {
+			dbg.E(TAG, "Error loading API keys : ", err)
+			return
+		}
+	} else {
+		adminSecret = *adminSecretFlag
+		if adminSecret == "" {
+			dbg.W(TAG, "Authentication disabled & no -adminsecret set - the admin routes can not be used")
+		}
+	}
+	var m *metrics.Metrics
+	var observer utils.Observer
+	if *enableMetrics {
+		m = metrics.New()
+		observer = m
+	}
+	geocoder, err = utils.NewGeocoder(utils.Options{
+		StateFile:      *stateFile,
+		ProvidersFile:  *providersFile,
+		CacheSize:      *cacheSize,
+		CachePrecision: *cachePrecision,
+		CacheTTL:       *cacheTTL,
+
+		CacheFile:           *cacheFile,
+		CacheFileMaxEntries: *cacheFileMaxEntries,
+
+		NearbyRadius: *nearbyRadius,
+
+		PlanUsageFile: *planUsageFile,
+
+		Observer: observer,
+	})
+	if err != nil {
+		dbg.E(TAG, "Error initializing geocoder : ", err)
+		return
+	}
+	jobs, err = utils.NewJobQueue(geocoder, *jobsDir, *jobTTL, *maxJobSize)
+	if err != nil {
+		dbg.E(TAG, "Error loading jobs : ", err)
+		return
+	}
 	dbg.I(TAG, "Initialised with port : %d", *port)
 	fnr := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		defer func() {
@@ -39,8 +145,23 @@ func main() {
 		}()
 		w.Write(GetReverseResult(r, ps))
 	}
-	router.GET("/reverse/:userId/:key/:reqId/:lat/:lng", fnr)
-	router.POST("/reverse/:userId/:key/:reqId/:lat/:lng", fnr)
+	router.GET("/reverse/:userId/:key/:reqId/:lat/:lng", authenticated(fnr, false))
+	router.POST("/reverse/:userId/:key/:reqId/:lat/:lng", authenticated(fnr, false))
+	// httprouter does not allow a static segment next to :userId, so /reverse/batch is matched here
+	router.POST("/reverse/:userId", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				dbg.E(TAG, "panic in reverse batch: %v for request : %v", err, dbg.GetRequest(r))
+				http.Error(w, http.StatusText(500), 500)
+			}
+		}()
+		if ps.ByName("userId") != "batch" {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(GetReverseBatchResult(w, r))
+	}, false))
 	fnf := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		defer func() {
 			if err := recover(); err != nil {
@@ -50,34 +171,114 @@ func main() {
 		}()
 		w.Write(GetForwardResult(r, ps))
 	}
-	router.GET("/forward/:userId/:key/:reqId/:addr", fnf)
-	router.POST("/forward/:userId/:key/:reqId/:addr", fnf)
-	router.GET("/reparseChain", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		b, err := ioutil.ReadFile("Providers.json")
+	router.GET("/forward/:userId/:key/:reqId/:addr", authenticated(fnf, false))
+	router.POST("/forward/:userId/:key/:reqId/:addr", authenticated(fnf, false))
+	router.POST("/forward/:userId", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				dbg.E(TAG, "panic in forward batch: %v for request : %v", err, dbg.GetRequest(r))
+				http.Error(w, http.StatusText(500), 500)
+			}
+		}()
+		if ps.ByName("userId") != "batch" {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		WriteForwardBatchResult(w, r)
+	}, false))
+	router.POST("/track", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				dbg.E(TAG, "panic in track: %v for request : %v", err, dbg.GetRequest(r))
+				http.Error(w, http.StatusText(500), 500)
+			}
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(GetTrackResult(w, r))
+	}, false))
+	router.POST("/jobs", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				dbg.E(TAG, "panic in jobs: %v for request : %v", err, dbg.GetRequest(r))
+				http.Error(w, http.StatusText(500), 500)
+			}
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(GetSubmitJobResult(w, r))
+	}, false))
+	fnj := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer func() {
+			if err := recover(); err != nil {
+				dbg.E(TAG, "panic in jobs: %v for request : %v", err, dbg.GetRequest(r))
+				http.Error(w, http.StatusText(500), 500)
+			}
+		}()
+		var res []byte
+		var err error
+		if r.Method == "DELETE" {
+			res, err = json.GetJsonCancelJob(jobs, ps.ByName("id"), r.FormValue("userId"))
+		} else {
+			res, err = json.GetJsonJob(jobs, ps.ByName("id"), r.FormValue("userId"))
+		}
+		if err != nil {
+			dbg.E(TAG, "Error getting job : ", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(res)
+	}
+	router.GET("/jobs/:id", authenticated(fnj, false))
+	router.DELETE("/jobs/:id", authenticated(fnj, false))
+	router.GET("/reparseChain", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		b, err := ioutil.ReadFile(*providersFile)
 		if err != nil {
 			dbg.E(TAG, "Error reading Providers.json : ", err)
 			http.Error(w, "Error reading Providers.json", 500)
 			return
 		}
-		err = utils.ParseProviders(b)
+		err = geocoder.ParseProviders(b)
 		if err != nil {
 			dbg.E(TAG, "Error parsing Providers.json : ", err)
 			http.Error(w, "Error parsing Providers.json", 500)
 			return
 		}
+		err = loadPlans(*plansFile)
+		if err != nil {
+			http.Error(w, "Error loading plans", 500)
+			return
+		}
+		if keyStore != nil {
+			err = keyStore.Reload()
+			if err != nil {
+				dbg.E(TAG, "Error reloading API keys : ", err)
+				http.Error(w, "Error reloading API keys", 500)
+				return
+			}
+		}
 		w.Write([]byte("Success!"))
-	})
+	}, true))
+	addAdminRoutes()
+	if m != nil {
+		m.Watch(geocoder)
+		h := m.Handler()
+		router.GET("/metrics", authenticated(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			h.ServeHTTP(w, r)
+		}, true))
+	}
 	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(404), 404)
 	})
-	b, err := ioutil.ReadFile("Providers.json")
+	b, err := ioutil.ReadFile(*providersFile)
 	if err != nil {
 		dbg.E(TAG, "Error reading Providers.json : ", err)
 	}
-	err = utils.ParseProviders(b)
+	err = geocoder.ParseProviders(b)
 	if err != nil {
 		dbg.E(TAG, "Error parsing Providers.json : ", err)
 	}
+	err = loadPlans(*plansFile)
+	if err != nil {
+		return
+	}
 	uri := fmt.Sprintf(":%d", *port)
 	dbg.I(TAG, "Starting server with uri : %s", uri)
 	go func() {
@@ -85,32 +286,281 @@ func main() {
 		signal.Notify(sigchan, os.Interrupt, os.Kill)
 		<-sigchan
 		dbg.I(TAG, "Shutting down...")
-		utils.SaveProviders(true)
+		jobs.Stop()
+		geocoder.Save(true)
+		geocoder.Close()
 		manners.Close()
 	}()
 
+	jobs.Start()
 	go func() {
 		for {
 			time.Sleep(15*time.Second)
-			utils.SaveProviders(false)
+			geocoder.Save(false)
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(24 * time.Hour)
+			geocoder.CompactCache()
 		}
 	}()
-	err = manners.ListenAndServe(uri, router)
+	var handler http.Handler = router
+	if m != nil {
+		handler = m.Middleware(router, endpointOf)
+	}
+	err = manners.ListenAndServe(uri, handler)
 	if err != nil {
 		dbg.E(TAG, "Error starting server : ", err)
 	}
 }
 
+// endpointOf returns the endpoint label of a request for the metrics.
+func endpointOf(r *http.Request) string {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	switch parts[0] {
+	case "reverse", "forward":
+		if len(parts) == 2 && parts[1] == "batch" {
+			return parts[0] + "_batch"
+		}
+		return parts[0]
+	case "track", "jobs", "status", "admin", "reparseChain", "metrics":
+		return parts[0]
+	}
+	return "other"
+}
+
+// loadPlans reads the plans from file - no file means no plans.
+func loadPlans(file string) (err error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return geocoder.SetPlans(utils.PlanConfig{})
+	} else if err != nil {
+		dbg.E(TAG, "Error reading plans : ", err)
+		return
+	}
+	err = geocoder.ParsePlans(b)
+	if err != nil {
+		dbg.E(TAG, "Error parsing plans : ", err)
+	}
+	return
+}
+
+// credentials returns the user id & API key of a request - from the route, from the query parameters userId & key or
+// from a "Authorization: Bearer KEY" header.
+func credentials(r *http.Request, ps httprouter.Params) (userId string, key string) {
+	userId, key = ps.ByName("userId"), ps.ByName("key")
+	if key == "" {
+		q := r.URL.Query()
+		userId, key = q.Get("userId"), q.Get("key")
+	}
+	if key == "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return
+}
+
+// authenticated only calls h if the API key of the request is valid for its user - or an admin key, if admin is set.
+// With authentication disabled, only admin routes are checked - against the admin secret.
+// Requests without or with an unknown key get 401, requests with a key that may not be used for them 403.
+func authenticated(h httprouter.Handle, admin bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if keyStore == nil && !admin {
+			h(w, r, ps)
+			return
+		}
+		uId, key := credentials(r, ps)
+		var err error
+		if keyStore == nil {
+			// authentication is disabled - admin routes still need the admin secret
+			if adminSecret == "" || subtle.ConstantTimeCompare([]byte(key), []byte(adminSecret)) != 1 {
+				err = utils.ErrUnauthorized
+			}
+		} else if admin {
+			_, err = keyStore.AuthenticateAdmin(key)
+		} else {
+			_, err = keyStore.Authenticate(uId, key)
+		}
+		if err == utils.ErrUnauthorized {
+			dbg.W(TAG, "Unauthorized request for user %s : %v", uId, dbg.GetRequest(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(401), 401)
+			return
+		} else if err != nil {
+			dbg.W(TAG, "Forbidden request for user %s : %v", uId, dbg.GetRequest(r))
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// requestContext returns the context to geocode the request with - it is cancelled when the client goes away or the
+// timeout is over. Clients can set the timeout with the query parameter timeout, e.g. 10s, up to -maxtimeout.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			timeout = d
+		} else {
+			dbg.W(TAG, "Ignoring invalid timeout %s", s)
+		}
+	}
+	if maxTimeout > 0 && (timeout <= 0 || timeout > maxTimeout) {
+		timeout = maxTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
 func GetReverseResult(r *http.Request, ps httprouter.Params) (res []byte) {
 
 	var err error
-	res, err = json.GetJsonReverseGeoCode(ps.ByName("lat"), ps.ByName("lng"), ps.ByName("reqId"), r.FormValue("dontChain") != "", ps.ByName("userId"))
+	ctx, cancel := requestContext(r)
+	defer cancel()
+	res, err = json.GetJsonReverseGeoCode(ctx, geocoder, ps.ByName("lat"), ps.ByName("lng"), ps.ByName("reqId"), r.FormValue("dontChain") != "", ps.ByName("userId"))
 	if err != nil {
 		dbg.E(TAG, "Error calling json.GetJsonReverseGeoCode : ", err)
 	}
 	return
 }
 
+// GetReverseBatchResult reverse geocodes the json array of {reqId, lat, lng} in the body - userId & key are passed as
+// query parameters.
+func GetReverseBatchResult(w http.ResponseWriter, r *http.Request) (res []byte) {
+	var err error
+	var b []byte
+	b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodySize))
+	if err != nil {
+		dbg.E(TAG, "Unable to read batch : ", err)
+		res, _ = js.Marshal([]models.GeoResp{json.GetErrorGeoCodeResponse("Could not read batch", "")})
+		return
+	}
+	q := r.URL.Query()
+	ctx, cancel := requestContext(r)
+	defer cancel()
+	res, err = json.GetJsonReverseBatch(ctx, geocoder, b, maxBatchSize, q.Get("dontChain") != "", q.Get("userId"))
+	if err != nil {
+		dbg.E(TAG, "Error calling json.GetJsonReverseBatch : ", err)
+	}
+	return
+}
+
+// GetSubmitJobResult adds a background job for the json array in the body - the same as for /reverse/batch or
+// /forward/batch, depending on the query parameter type (reverse or forward). userId & key are passed as query parameters.
+func GetSubmitJobResult(w http.ResponseWriter, r *http.Request) (res []byte) {
+	var err error
+	var b []byte
+	b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxJobBodySize))
+	if err != nil {
+		dbg.E(TAG, "Unable to read job : ", err)
+		res, _ = js.Marshal(models.JobResp{Error: "Could not read job"})
+		return
+	}
+	q := r.URL.Query()
+	res, err = json.GetJsonSubmitJob(jobs, b, q.Get("type"), q.Get("dontChain") != "", q.Get("userId"))
+	if err != nil {
+		dbg.E(TAG, "Error calling json.GetJsonSubmitJob : ", err)
+	}
+	return
+}
+
+// GetTrackResult reverse geocodes the stops of the GPX or GeoJSON track in the body - userId, key & reqId are passed as
+// query parameters, as well as the optional thresholds minDwell (e.g. 5m) and maxDistance (metres).
+func GetTrackResult(w http.ResponseWriter, r *http.Request) (res []byte) {
+	var err error
+	var b []byte
+	q := r.URL.Query()
+	b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodySize))
+	if err != nil {
+		dbg.E(TAG, "Unable to read track : ", err)
+		res, _ = js.Marshal(models.TrackResp{ReqId: q.Get("reqId"), Error: "Could not read track"})
+		return
+	}
+	stopOpts := utils.StopOptions{SkipEndpoints: q.Get("skipEndpoints") != ""}
+	if s := q.Get("minDwell"); s != "" {
+		stopOpts.MinDwell, err = time.ParseDuration(s)
+		if err != nil {
+			res, _ = js.Marshal(models.TrackResp{ReqId: q.Get("reqId"), Error: "minDwell not parsable"})
+			return
+		}
+	}
+	if s := q.Get("maxDistance"); s != "" {
+		stopOpts.MaxDistance, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			res, _ = js.Marshal(models.TrackResp{ReqId: q.Get("reqId"), Error: "maxDistance not parsable"})
+			return
+		}
+	}
+	ctx, cancel := requestContext(r)
+	defer cancel()
+	res, err = json.GetJsonTrackStops(ctx, geocoder, b, stopOpts, q.Get("reqId"), q.Get("dontChain") != "", q.Get("userId"))
+	if err != nil {
+		dbg.E(TAG, "Error calling json.GetJsonTrackStops : ", err)
+	}
+	return
+}
+
+// WriteForwardBatchResult forward geocodes the batch in the body - userId & key are passed as query parameters.
+// A json array of {reqId, address} (or street, houseNumber, postal, city & country instead of address) is answered with
+// a json array, a csv (Content-Type text/csv or a multipart upload with the field "file") with the same csv and the
+// result columns appended. The address columns of the csv are given by the query parameter addressColumn or
+// streetColumn, houseNumberColumn, postalColumn, cityColumn & countryColumn.
+func WriteForwardBatchResult(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	ctx, cancel := requestContext(r)
+	defer cancel()
+	ct := r.Header.Get("Content-Type")
+	if strings.HasPrefix(ct, "text/csv") || strings.HasPrefix(ct, "multipart/form-data") {
+		body := io.Reader(r.Body)
+		if strings.HasPrefix(ct, "multipart/form-data") {
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				dbg.E(TAG, "Unable to read csv upload : ", err)
+				http.Error(w, "Could not read csv upload", 400)
+				return
+			}
+			defer f.Close()
+			body = f
+		}
+		cols := csv.Columns{
+			Address:     q.Get("addressColumn"),
+			Street:      q.Get("streetColumn"),
+			HouseNumber: q.Get("houseNumberColumn"),
+			Postal:      q.Get("postalColumn"),
+			City:        q.Get("cityColumn"),
+			Country:     q.Get("countryColumn"),
+		}
+		var out bytes.Buffer
+		err := csv.GeoCodeCsv(ctx, geocoder, body, &out, cols, maxBatchSize, q.Get("dontChain") != "", q.Get("userId"))
+		if err != nil {
+			dbg.W(TAG, "Error calling csv.GeoCodeCsv : ", err)
+			http.Error(w, "Could not geocode csv : "+err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(out.Bytes())
+		return
+	}
+
+	var res []byte
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		dbg.E(TAG, "Unable to read batch : ", err)
+		res, _ = js.Marshal([]models.GeoResp{json.GetErrorGeoCodeResponse("Could not read batch", "")})
+	} else {
+		res, err = json.GetJsonForwardBatch(ctx, geocoder, b, maxBatchSize, q.Get("dontChain") != "", q.Get("userId"))
+		if err != nil {
+			dbg.E(TAG, "Error calling json.GetJsonForwardBatch : ", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
 func GetForwardResult(r *http.Request, ps httprouter.Params) (res []byte) {
 
 	var err error
@@ -121,7 +571,19 @@ func GetForwardResult(r *http.Request, ps httprouter.Params) (res []byte) {
 		res, _ = js.Marshal(json.GetErrorGeoCodeResponse("Could not parse address",ps.ByName("reqId")))
 		return
 	}
-	res, err = json.GetJsonGeoCode(a,  ps.ByName("reqId"), r.FormValue("dontChain") != "", ps.ByName("userId"))
+	opts := utils.RequestOptions{UserId: ps.ByName("userId"), DontChain: r.FormValue("dontChain") != "", Country: r.FormValue("country")}
+	if s := r.FormValue("focus"); s != "" {
+		var lat, lng float64
+		_, err = fmt.Sscanf(s, "%f,%f", &lat, &lng)
+		if err != nil {
+			res, _ = js.Marshal(json.GetErrorGeoCodeResponse("focus not parsable", ps.ByName("reqId")))
+			return
+		}
+		opts.Focus = &utils.BatchPoint{Lat: lat, Lng: lng}
+	}
+	ctx, cancel := requestContext(r)
+	defer cancel()
+	res, err = json.GetJsonGeoCode(ctx, geocoder, a, ps.ByName("reqId"), opts)
 	if err != nil {
 		dbg.E(TAG, "Error calling json.GetJsonGeoCode : ", err)
 	}
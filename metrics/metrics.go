@@ -0,0 +1,182 @@
+// Package metrics exports what the Geocoder does as prometheus metrics.
+package metrics
+
+import (
+	"github.com/OpenDriversLog/odl-geocoder/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "odl_geocoder"
+
+// Metrics collects the metrics of a Geocoder - pass it as utils.Options.Observer and call Watch with the Geocoder.
+// It is safe for concurrent use.
+type Metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	requestLatency   *prometheus.HistogramVec
+	providerRequests *prometheus.CounterVec
+	providerLatency  *prometheus.HistogramVec
+	cacheLookups     *prometheus.CounterVec
+}
+
+// New creates the metrics, registered to their own registry together with the go & process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by endpoint & outcome.",
+		}, []string{"endpoint", "outcome"}),
+		requestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by endpoint.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 9),
+		}, []string{"endpoint"}),
+		providerRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "provider_requests_total",
+			Help:      "Requests to the providers by provider & outcome (success, empty, skip, need_fix, error).",
+		}, []string{"provider", "outcome"}),
+		providerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "provider_request_duration_seconds",
+			Help:      "Duration of the requests sent to the providers.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+		}, []string{"provider"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups by result (hit, nearby, miss).",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestLatency, m.providerRequests, m.providerLatency, m.cacheLookups,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// ProviderRequest implements utils.Observer.
+func (m *Metrics) ProviderRequest(provider string, outcome string, latency time.Duration) {
+	m.providerRequests.WithLabelValues(provider, outcome).Inc()
+	if latency > 0 {
+		m.providerLatency.WithLabelValues(provider).Observe(latency.Seconds())
+	}
+}
+
+// CacheLookup implements utils.Observer.
+func (m *Metrics) CacheLookup(result string) {
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+// Watch exports the remaining contingent of the providers of g as gauges.
+func (m *Metrics) Watch(g *utils.Geocoder) {
+	m.registry.MustRegister(quotaCollector{g: g})
+}
+
+// Handler serves the metrics for prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts the requests handled by next. endpoint returns the endpoint label of a request - keep the number
+// of different values small.
+func (m *Metrics) Middleware(next http.Handler, endpoint func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		next.ServeHTTP(sw, r)
+		e := endpoint(r)
+		m.requests.WithLabelValues(e, outcome(sw.status)).Inc()
+		m.requestLatency.WithLabelValues(e).Observe(time.Since(start).Seconds())
+	})
+}
+
+// outcome returns the outcome label for a HTTP status code.
+func outcome(status int) string {
+	switch {
+	case status < 400:
+		return "ok"
+	case status == 401:
+		return "unauthorized"
+	case status == 403:
+		return "forbidden"
+	case status == 404:
+		return "not_found"
+	case status < 500:
+		return "client_error"
+	}
+	return "server_error"
+}
+
+// statusWriter remembers the status code written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+var (
+	quotaUsedDesc = prometheus.NewDesc(namespace+"_provider_requests_used",
+		"Requests used in the current interval of the provider.", []string{"provider"}, nil)
+	quotaMaxDesc = prometheus.NewDesc(namespace+"_provider_requests_max",
+		"Max requests per interval of the provider, 0 if unknown or unlimited.", []string{"provider"}, nil)
+	quotaRemainingDesc = prometheus.NewDesc(namespace+"_provider_requests_remaining",
+		"Requests left in the current interval of the provider - only for providers with a known limit.", []string{"provider"}, nil)
+	disabledDesc = prometheus.NewDesc(namespace+"_provider_disabled",
+		"1 if the provider is disabled.", []string{"provider"}, nil)
+	availableDesc = prometheus.NewDesc(namespace+"_provider_available",
+		"1 if the provider would be asked right now, 0 if it is skipped.", []string{"provider"}, nil)
+	circuitOpenDesc = prometheus.NewDesc(namespace+"_provider_circuit_open",
+		"1 if the circuit breaker of the provider is open after too many errors.", []string{"provider"}, nil)
+)
+
+// quotaCollector reads the contingents of the providers on every scrape.
+type quotaCollector struct {
+	g *utils.Geocoder
+}
+
+func (c quotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaUsedDesc
+	ch <- quotaMaxDesc
+	ch <- quotaRemainingDesc
+	ch <- disabledDesc
+	ch <- availableDesc
+	ch <- circuitOpenDesc
+}
+
+func (c quotaCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.g.Status().Providers {
+		ch <- prometheus.MustNewConstMetric(quotaUsedDesc, prometheus.GaugeValue, float64(p.CurIntervalRequests), p.Name)
+		ch <- prometheus.MustNewConstMetric(quotaMaxDesc, prometheus.GaugeValue, float64(p.MaxRequestsPerInterval), p.Name)
+		if p.MaxRequestsPerInterval > 0 {
+			remaining := p.MaxRequestsPerInterval - p.CurIntervalRequests
+			if remaining < 0 {
+				remaining = 0
+			}
+			ch <- prometheus.MustNewConstMetric(quotaRemainingDesc, prometheus.GaugeValue, float64(remaining), p.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(disabledDesc, prometheus.GaugeValue, boolValue(p.Disabled), p.Name)
+		ch <- prometheus.MustNewConstMetric(availableDesc, prometheus.GaugeValue, boolValue(p.SkipReason == ""), p.Name)
+		ch <- prometheus.MustNewConstMetric(circuitOpenDesc, prometheus.GaugeValue, boolValue(p.BreakerState == utils.BreakerOpen), p.Name)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var _ utils.Observer = (*Metrics)(nil)
@@ -1,5 +1,10 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 /*
 Models for odl-geocoder - make sure to keep in sync with goodl-lib/models/odl-geocode
 Having this redundancy because importing odl-geocoder in goodl-lib is quite annoying.
@@ -16,6 +21,64 @@ type GeoResp struct {
 	CurUserRequestsUsed  int
 	Error                string
 	Provider string
+	FromCache bool // result was served from cache and did not count against CurUserRequestsUsed
+	CacheDistance float64 // metres between the requested coordinates and the cached lookup that was used
+	NoCache bool // the terms of the provider do not allow to store the address
+}
+
+// ReverseBatchItem is a single coordinate of a POST /reverse/batch request
+type ReverseBatchItem struct {
+	ReqId string  `json:"reqId"`
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+}
+
+// ForwardBatchItem is a single address of a POST /forward/batch request - either Address or its parts need to be set.
+type ForwardBatchItem struct {
+	ReqId       string `json:"reqId"`
+	Address     string `json:"address"`
+	Street      string `json:"street"`
+	HouseNumber string `json:"houseNumber"`
+	Postal      string `json:"postal"`
+	City        string `json:"city"`
+	Country     string `json:"country"`
+}
+
+// TrackResp is the response of a POST /track request - the detected stops of the track in order.
+type TrackResp struct {
+	ReqId                string
+	Stops                []TrackStop
+	MaxRequestsPerDay    int
+	MaxRequestsPerUser   int
+	CurDailyRequestsUsed int
+	CurUserRequestsUsed  int
+	Error                string
+}
+
+// TrackStop is a place a track stayed at, with its reverse geocoded address.
+type TrackStop struct {
+	Lat       float64
+	Lng       float64
+	Arrival   time.Time
+	Departure time.Time
+	Address   Address
+	Provider  string
+	FromCache bool
+	Error     string
+}
+
+// JobResp is the response of the /jobs endpoints. Results holds the items that are done so far, in order.
+type JobResp struct {
+	Id           string
+	Type         string
+	Status       string // queued, running, waiting (for the providers to have requests again), done or cancelled
+	Created      time.Time
+	Updated      time.Time
+	WaitingUntil time.Time
+	Total        int
+	Done         int
+	Results      []GeoResp
+	Error        string
 }
 
 type Address struct {
@@ -34,9 +97,10 @@ type Address struct {
 }
 
 type GeoCodeProvider struct {
-	Type                     int64          // needs to be set up manually - 1=geocode.farm, 2 = Chained odl-geocoder
+	Type                     int64          // legacy, only used if TypeName is empty - 1=geocode.farm, 2 = Chained odl-geocoder, 3 = TomTom, 4 = OpenCage
+	TypeName                 string         // needs to be set up manually - name of a registered provider type, e.g. geocodefarm, chain, tomtom, opencage
 	Name                     string         // needs to be set up manually
-	Key1                     string         // currently not used
+	Key1                     string         // api key - for chained odl-geocoders a key of type chain
 	Key2                     string         // currently not used
 	Key3                     string         // currently not used
 	Key4                     string         // currently not used
@@ -45,6 +109,7 @@ type GeoCodeProvider struct {
 	CurIntervalRequests      int            // usually gets filled automatically, as the provider returns the limits on a request
 	MaxRequestsPerUserAndDay int            // for chained geocoder gets set automatically, manually for geocode.farm
 	IntervalSizeInDays       int            // needs to be set up manually
+	IntervalMonthly          bool           // the contingent is per calendar month (UTC), e.g. for HERE - IntervalSizeInDays is ignored
 	LastRequestTime          int64          // UnixNano of last request
 	NextAllowedRequestTime   int64          // UnixNano when next request is allowed
 	TimeBetweenRequests      int64          // time in nanoseconds that needs to be wait between requests
@@ -53,6 +118,17 @@ type GeoCodeProvider struct {
 	ChainingForbidden	bool
 	Priority		int		// higher is better
 	FirstIntervalRequest	int64		// time when the current request interval started
+	UsersToReqCountDay	string		// UTC day (2006-01-02) UsersToReqCount counts the requests of
+	AllowedUsers	[]string	// if this or AllowedPlans is set, only these users may use the provider
+	AllowedPlans	[]string	// if this or AllowedUsers is set, only users with these plans may use the provider
+	DeniedUsers	[]string	// these users may not use the provider
+	DeniedPlans	[]string	// users with these plans may not use the provider
+	BreakerThreshold	int	// errors in a row until the provider is paused (circuit open), default 3
+	BreakerBackoff	int64	// nanoseconds the provider is paused the first time, doubled for every failed trial request - default 5 seconds
+	BreakerMaxBackoff	int64	// max nanoseconds the provider is paused, default 1 hour
+	UserAgent	string	// User-Agent sent to the provider, default odl-geocoder - nominatim wants one that identifies us
+	Email	string	// contact address sent to providers that ask for one, e.g. nominatim
+	Options	map[string]string	// options only a single provider type knows, e.g. reverseTypes of mapbox - read by the provider itself
 }
 
 type GeoCodeFarmResp struct {
@@ -258,4 +334,177 @@ type OpenCageTimestamp struct {
 type OpenCageStatus struct {
 	Code int `json:"code"`
 	Message string `json:"message"`
-}
\ No newline at end of file
+}
+// NominatimResult is a single place of a Nominatim reverse (format=jsonv2) or search response.
+type NominatimResult struct {
+	PlaceId int64 `json:"place_id"`
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+	Category string `json:"category"`
+	Type string `json:"type"`
+	PlaceRank int `json:"place_rank"`
+	Importance float64 `json:"importance"`
+	DisplayName string `json:"display_name"`
+	Address NominatimAddress `json:"address"`
+	Error json.RawMessage `json:"error"` // reverse only, set if nothing was found
+}
+
+type NominatimAddress struct {
+	HouseNumber string `json:"house_number"`
+	Road string `json:"road"`
+	Pedestrian string `json:"pedestrian"`
+	Footway string `json:"footway"`
+	Suburb string `json:"suburb"`
+	Hamlet string `json:"hamlet"`
+	Village string `json:"village"`
+	Town string `json:"town"`
+	City string `json:"city"`
+	Municipality string `json:"municipality"`
+	Postcode string `json:"postcode"`
+	State string `json:"state"`
+	Country string `json:"country"`
+	CountryCode string `json:"country_code"`
+}
+
+// PhotonResp is the GeoJSON FeatureCollection Photon answers /api & /reverse requests with.
+type PhotonResp struct {
+	Type string `json:"type"`
+	Features []PhotonFeature `json:"features"`
+}
+
+type PhotonFeature struct {
+	Type string `json:"type"`
+	Geometry PhotonGeometry `json:"geometry"`
+	Properties PhotonProperties `json:"properties"`
+}
+
+type PhotonGeometry struct {
+	Type string `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // lng, lat
+}
+
+type PhotonProperties struct {
+	OsmId int64 `json:"osm_id"`
+	OsmType string `json:"osm_type"`
+	OsmKey string `json:"osm_key"` // e.g. amenity
+	OsmValue string `json:"osm_value"` // e.g. fuel
+	Type string `json:"type"` // house, street, city, ...
+	Name string `json:"name"`
+	HouseNumber string `json:"housenumber"`
+	Street string `json:"street"`
+	Postcode string `json:"postcode"`
+	District string `json:"district"`
+	Locality string `json:"locality"`
+	City string `json:"city"`
+	County string `json:"county"`
+	State string `json:"state"`
+	Country string `json:"country"`
+	CountryCode string `json:"countrycode"`
+}
+
+// PeliasResp is the GeoJSON FeatureCollection Pelias answers /v1/search, /v1/search/structured & /v1/reverse with.
+type PeliasResp struct {
+	Type string `json:"type"`
+	Features []PeliasFeature `json:"features"`
+}
+
+type PeliasFeature struct {
+	Type string `json:"type"`
+	Geometry PeliasGeometry `json:"geometry"`
+	Properties PeliasProperties `json:"properties"`
+}
+
+type PeliasGeometry struct {
+	Type string `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // lng, lat
+}
+
+type PeliasProperties struct {
+	Id string `json:"id"`
+	Layer string `json:"layer"` // address, street, venue, locality, ...
+	Source string `json:"source"`
+	Name string `json:"name"`
+	HouseNumber string `json:"housenumber"`
+	Street string `json:"street"`
+	PostalCode string `json:"postalcode"`
+	Confidence float64 `json:"confidence"` // 0 - 1
+	Distance float64 `json:"distance"` // km, reverse only
+	Country string `json:"country"`
+	CountryA string `json:"country_a"` // ISO 3166 alpha-3
+	CountryCode string `json:"country_code"` // ISO 3166 alpha-2, newer versions only
+	Region string `json:"region"`
+	County string `json:"county"`
+	LocalAdmin string `json:"localadmin"`
+	Locality string `json:"locality"`
+	Borough string `json:"borough"`
+	Neighbourhood string `json:"neighbourhood"`
+	Label string `json:"label"`
+}
+
+// HereResp is the response of the HERE Geocoding & Search v7 geocode & revgeocode endpoints.
+type HereResp struct {
+	Items []HereItem `json:"items"`
+}
+
+type HereItem struct {
+	Title string `json:"title"`
+	Id string `json:"id"`
+	ResultType string `json:"resultType"` // houseNumber, street, locality, place, ...
+	Address HereAddress `json:"address"`
+	Position HerePosition `json:"position"`
+	Distance int `json:"distance"` // metres, revgeocode only
+	Scoring HereScoring `json:"scoring"` // geocode only
+}
+
+type HereAddress struct {
+	Label string `json:"label"`
+	CountryCode string `json:"countryCode"` // ISO 3166 alpha-3
+	CountryName string `json:"countryName"`
+	State string `json:"state"`
+	County string `json:"county"`
+	City string `json:"city"`
+	District string `json:"district"`
+	Street string `json:"street"`
+	PostalCode string `json:"postalCode"`
+	HouseNumber string `json:"houseNumber"`
+}
+
+type HerePosition struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type HereScoring struct {
+	QueryScore float64 `json:"queryScore"` // 0 - 1
+}
+
+// MapboxResp is the response of the Mapbox Geocoding v5 api, a GeoJSON FeatureCollection.
+type MapboxResp struct {
+	Type string `json:"type"`
+	Features []MapboxFeature `json:"features"`
+}
+
+type MapboxFeature struct {
+	Id string `json:"id"` // <place type>.<id>, e.g. address.123
+	PlaceType []string `json:"place_type"` // country, region, postcode, place, locality, neighborhood, address, poi
+	Relevance float64 `json:"relevance"` // 0 - 1
+	Address string `json:"address"` // house number
+	Text string `json:"text"` // name of the feature, e.g. the street of an address
+	PlaceName string `json:"place_name"`
+	Center []float64 `json:"center"` // lng, lat
+	Properties MapboxProperties `json:"properties"`
+	Context []MapboxContext `json:"context"`
+}
+
+type MapboxProperties struct {
+	Address string `json:"address"` // street & house number of a poi
+	Category string `json:"category"`
+	ShortCode string `json:"short_code"` // ISO 3166 code of countries & regions
+}
+
+// MapboxContext is one of the features the result lies in, e.g. its postcode, place, region & country.
+type MapboxContext struct {
+	Id string `json:"id"`
+	Text string `json:"text"`
+	ShortCode string `json:"short_code"` // ISO 3166 alpha-2 for countries, e.g. de
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"io/ioutil"
+	"os"
+)
+
+var ErrProviderNotFound = errors.New("Provider not found")
+var ErrProviderExists = errors.New("Provider with this name already exists")
+var ErrProviderNameMissing = errors.New("Provider needs a name")
+
+// RedactedKey replaces the api keys of providers shown by the admin api - UpdateProvider keeps the current key for it.
+const RedactedKey = "<redacted>"
+
+// changeProviders calls change with a copy of the configured providers and uses the result from now on. Request counts
+// of providers that keep their name are kept. Changes are serialized, so none of them gets lost. If a ProvidersFile is
+// configured, a change is only used if it could be saved to it.
+func (g *Geocoder) changeProviders(change func(provs []*models.GeoCodeProvider) ([]*models.GeoCodeProvider, error)) (err error) {
+	g.adminMu.Lock()
+	defer g.adminMu.Unlock()
+	cur := g.Providers()
+	provs := make([]*models.GeoCodeProvider, len(cur))
+	for i := range cur {
+		provs[i] = &cur[i]
+	}
+	provs, err = change(provs)
+	if err != nil {
+		return
+	}
+	if g.providersFile == "" {
+		return g.SetProviders(provs)
+	}
+	old := g.Providers()
+	// write the new config next to the file first - it is only moved in place once the change is live, so the file
+	// & the providers in use never differ
+	tmp := g.providersFile + ".tmp"
+	err = writeProvidersConfig(tmp, provs)
+	if err != nil {
+		g.log.E(TAG, "Error saving providers : ", err)
+		return
+	}
+	err = g.SetProviders(provs)
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	err = os.Rename(tmp, g.providersFile)
+	if err != nil {
+		g.log.E(TAG, "Error saving providers - the change is rolled back : ", err)
+		os.Remove(tmp)
+		rollback := make([]*models.GeoCodeProvider, len(old))
+		for i := range old {
+			rollback[i] = &old[i]
+		}
+		if _err := g.SetProviders(rollback); _err != nil {
+			g.log.E(TAG, "Error rolling back providers : ", _err)
+		}
+	}
+	return
+}
+
+func providerIdx(provs []*models.GeoCodeProvider, name string) int {
+	for i, v := range provs {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddProvider adds a provider to the end of the chain.
+func (g *Geocoder) AddProvider(p models.GeoCodeProvider) error {
+	if p.Name == "" {
+		return ErrProviderNameMissing
+	}
+	return g.changeProviders(func(provs []*models.GeoCodeProvider) ([]*models.GeoCodeProvider, error) {
+		if providerIdx(provs, p.Name) >= 0 {
+			return nil, ErrProviderExists
+		}
+		return append(provs, &p), nil
+	})
+}
+
+// UpdateProvider replaces the configuration of the provider with the given name - its request counts are kept.
+// p may have a new name, as long as no other provider has it.
+func (g *Geocoder) UpdateProvider(name string, p models.GeoCodeProvider) error {
+	if p.Name == "" {
+		p.Name = name
+	}
+	return g.changeProviders(func(provs []*models.GeoCodeProvider) ([]*models.GeoCodeProvider, error) {
+		idx := providerIdx(provs, name)
+		if idx < 0 {
+			return nil, ErrProviderNotFound
+		}
+		if p.Name != name && providerIdx(provs, p.Name) >= 0 {
+			return nil, ErrProviderExists
+		}
+		keepRedactedKeys(provs[idx], &p)
+		copyRequestCounts(provs[idx], &p)
+		provs[idx] = &p
+		return provs, nil
+	})
+}
+
+// keepRedactedKeys keeps the keys of cur that are RedactedKey in p - clients can send back a provider they got from the
+// admin api without knowing its keys.
+func keepRedactedKeys(cur *models.GeoCodeProvider, p *models.GeoCodeProvider) {
+	for _, k := range []struct{ cur, p *string }{{&cur.Key1, &p.Key1}, {&cur.Key2, &p.Key2}, {&cur.Key3, &p.Key3}, {&cur.Key4, &p.Key4}} {
+		if *k.p == RedactedKey {
+			*k.p = *k.cur
+		}
+	}
+}
+
+// RedactKeys returns p with its api keys replaced by RedactedKey, to show it without giving away the keys.
+func RedactKeys(p models.GeoCodeProvider) models.GeoCodeProvider {
+	for _, k := range []*string{&p.Key1, &p.Key2, &p.Key3, &p.Key4} {
+		if *k != "" {
+			*k = RedactedKey
+		}
+	}
+	return p
+}
+
+// SetProviderDisabled disables or enables the provider with the given name.
+func (g *Geocoder) SetProviderDisabled(name string, disabled bool) error {
+	return g.changeProviders(func(provs []*models.GeoCodeProvider) ([]*models.GeoCodeProvider, error) {
+		idx := providerIdx(provs, name)
+		if idx < 0 {
+			return nil, ErrProviderNotFound
+		}
+		provs[idx].Disabled = disabled
+		return provs, nil
+	})
+}
+
+// RemoveProvider removes the provider with the given name from the chain.
+func (g *Geocoder) RemoveProvider(name string) error {
+	return g.changeProviders(func(provs []*models.GeoCodeProvider) ([]*models.GeoCodeProvider, error) {
+		idx := providerIdx(provs, name)
+		if idx < 0 {
+			return nil, ErrProviderNotFound
+		}
+		return append(provs[:idx], provs[idx+1:]...), nil
+	})
+}
+
+// ResetProviderCounts forgets the requests made to the provider with the given name in the current interval, e.g.
+// after its contingent was raised.
+func (g *Geocoder) ResetProviderCounts(name string) (err error) {
+	g.providersMu.RLock()
+	defer g.providersMu.RUnlock()
+	for _, p := range g.allProviders {
+		if p.name == name {
+			p.Lock()
+			p.prov.CurIntervalRequests = 0
+			p.prov.FirstIntervalRequest = 0
+			p.prov.NextAllowedRequestTime = 0
+			p.prov.UsersToReqCount = make(map[string]int)
+			p.prov.UsersToReqCountDay = ""
+			p.Unlock()
+			g.markChanged()
+			return
+		}
+	}
+	return ErrProviderNotFound
+}
+
+// Provider returns a copy of the provider with the given name.
+func (g *Geocoder) Provider(name string) (p models.GeoCodeProvider, err error) {
+	g.providersMu.RLock()
+	defer g.providersMu.RUnlock()
+	for _, v := range g.allProviders {
+		if v.name == name {
+			return v.copyProvider(), nil
+		}
+	}
+	return p, ErrProviderNotFound
+}
+
+// SaveProvidersConfig writes the configuration of the providers to file (usually Providers.json), leaving out the
+// request counts and fields that are not set. The file is replaced atomically.
+func (g *Geocoder) SaveProvidersConfig(file string) (err error) {
+	g.adminMu.Lock()
+	defer g.adminMu.Unlock()
+	cur := g.Providers()
+	provs := make([]*models.GeoCodeProvider, len(cur))
+	for i := range cur {
+		provs[i] = &cur[i]
+	}
+	err = writeProvidersConfig(file+".tmp", provs)
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	return
+}
+
+// writeProvidersConfig writes the configuration of provs to file, leaving out the request counts and fields that are
+// not set. The file is only readable by us, as it contains the api keys.
+func writeProvidersConfig(file string, provs []*models.GeoCodeProvider) (err error) {
+	conf := make([]models.GeoCodeProvider, len(provs))
+	for i, p := range provs {
+		conf[i] = *p
+		conf[i].CurIntervalRequests = 0
+		conf[i].FirstIntervalRequest = 0
+		conf[i].LastRequestTime = 0
+		conf[i].NextAllowedRequestTime = 0
+		conf[i].UsersToReqCount = nil
+		conf[i].UsersToReqCountDay = ""
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return
+	}
+	// drop unset fields, so the file stays readable
+	var generic []map[string]interface{}
+	err = json.Unmarshal(b, &generic)
+	if err != nil {
+		return
+	}
+	for _, p := range generic {
+		for k, v := range p {
+			switch t := v.(type) {
+			case nil:
+				delete(p, k)
+			case bool:
+				if !t {
+					delete(p, k)
+				}
+			case float64:
+				if t == 0 {
+					delete(p, k)
+				}
+			case string:
+				if t == "" {
+					delete(p, k)
+				}
+			case []interface{}:
+				if len(t) == 0 {
+					delete(p, k)
+				}
+			case map[string]interface{}:
+				if len(t) == 0 {
+					delete(p, k)
+				}
+			}
+		}
+	}
+	b, err = json.MarshalIndent(generic, "", "  ")
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(file, b, os.FileMode(0600))
+	if err == nil {
+		// WriteFile keeps the mode of a file that already existed
+		err = os.Chmod(file, os.FileMode(0600))
+	}
+	return
+}
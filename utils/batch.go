@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrEmptyQuery = errors.New("No address provided")
+
+// BatchPoint is a single coordinate of a reverse batch.
+type BatchPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// BatchResult is the result for a single item of a batch.
+type BatchResult struct {
+	Result
+	Err error
+}
+
+// ReverseBatch reverse geocodes all points one after another, so the contingents per user are respected across the
+// whole batch. Identical points are only looked up once. The results are in the same order as the points.
+func (g *Geocoder) ReverseBatch(ctx context.Context, points []BatchPoint, opts RequestOptions) []BatchResult {
+	keys := make([]string, len(points))
+	for i, p := range points {
+		keys[i] = fmt.Sprintf("%v|%v", p.Lat, p.Lng)
+	}
+	return g.batch(ctx, keys, func(i int) (Result, error) {
+		return g.Reverse(ctx, points[i].Lat, points[i].Lng, opts)
+	})
+}
+
+// ForwardBatch forward geocodes all addresses one after another, so the contingents per user are respected across the
+// whole batch. Identical addresses (ignoring case, commas & whitespace) are only looked up once. The results are in the
+// same order as the addresses.
+func (g *Geocoder) ForwardBatch(ctx context.Context, addresses []string, opts RequestOptions) []BatchResult {
+	keys := make([]string, len(addresses))
+	for i, s := range addresses {
+		keys[i] = ForwardCacheKey(s)
+	}
+	return g.batch(ctx, keys, func(i int) (Result, error) {
+		if addresses[i] == "" {
+			return Result{}, ErrEmptyQuery
+		}
+		return g.Forward(ctx, addresses[i], opts)
+	})
+}
+
+// ForwardStructuredBatch is ForwardBatch for addresses given in parts - see ForwardStructured.
+func (g *Geocoder) ForwardStructuredBatch(ctx context.Context, addresses []StructuredAddress, opts RequestOptions) []BatchResult {
+	keys := make([]string, len(addresses))
+	for i, a := range addresses {
+		keys[i] = ForwardCacheKey(a.String())
+	}
+	return g.batch(ctx, keys, func(i int) (Result, error) {
+		if addresses[i].String() == "" {
+			return Result{}, ErrEmptyQuery
+		}
+		return g.ForwardStructured(ctx, addresses[i], opts)
+	})
+}
+
+// JoinAddress builds an address to forward geocode out of its parts, e.g. "Walterstal 101, 09599 Freiberg, Germany".
+// Empty parts are left out.
+func JoinAddress(street string, houseNumber string, postal string, city string, country string) string {
+	var parts []string
+	for _, p := range []string{
+		strings.TrimSpace(strings.TrimSpace(street) + " " + strings.TrimSpace(houseNumber)),
+		strings.TrimSpace(strings.TrimSpace(postal) + " " + strings.TrimSpace(city)),
+		strings.TrimSpace(country),
+	} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// batch calls lookup for every index with a key it did not see before and copies the result to all items with the
+// same key. Once ctx is done, all remaining items get its error.
+func (g *Geocoder) batch(ctx context.Context, keys []string, lookup func(i int) (Result, error)) []BatchResult {
+	res := make([]BatchResult, len(keys))
+	firstIdx := make(map[string]int)
+	for i, key := range keys {
+		if idx, ok := firstIdx[key]; ok {
+			res[i] = res[idx]
+			continue
+		}
+		firstIdx[key] = i
+		if err := ctx.Err(); err != nil {
+			res[i].Err = err
+			continue
+		}
+		res[i].Result, res[i].Err = lookup(i)
+	}
+	return res
+}
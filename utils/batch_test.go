@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newBatchGeocoder returns a Geocoder with a tomtom provider that counts the requests per path.
+func newBatchGeocoder(t *testing.T) (*Geocoder, func() map[string]int) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/geocode/") {
+			fmt.Fprint(w, `{"results":[{"address":{"streetNumber":"101","streetName":"Walterstal","municipality":"Freiberg","postalCode":"09599","freeformAddress":"Walterstal 101, 09599 Freiberg"},"position":{"lat":50.9,"lon":13.3}}]}`)
+			return
+		}
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	t.Cleanup(srv.Close)
+	g, err := NewGeocoder(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"tomtom","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1}]`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		c := make(map[string]int, len(paths))
+		for k, v := range paths {
+			c[k] = v
+		}
+		return c
+	}
+}
+
+func TestReverseBatchDeduplicates(t *testing.T) {
+	g, asked := newBatchGeocoder(t)
+	points := []BatchPoint{{1, 2}, {3, 4}, {1, 2}, {5, 6}, {3, 4}, {1, 2}}
+	res := g.ReverseBatch(context.Background(), points, RequestOptions{UserId: "a"})
+	if len(res) != len(points) {
+		t.Fatalf("got %d results for %d points", len(res), len(points))
+	}
+	for i, r := range res {
+		if r.Err != nil || r.Address.Street != "Walterstal" {
+			t.Errorf("result %d : %+v", i, r)
+		}
+	}
+	paths := asked()
+	for _, p := range []string{"/reverseGeocode/1.000000,2.000000.JSON", "/reverseGeocode/3.000000,4.000000.JSON", "/reverseGeocode/5.000000,6.000000.JSON"} {
+		if paths[p] != 1 {
+			t.Errorf("provider asked %d times for %s, want 1", paths[p], p)
+		}
+	}
+	if len(paths) != 3 {
+		t.Errorf("provider asked for %v, want the 3 different points", paths)
+	}
+	if _, _, _, used := g.RequestCounts("a"); used != 3 {
+		t.Errorf("user used %d requests, want 3", used)
+	}
+}
+
+func TestForwardBatchDeduplicates(t *testing.T) {
+	g, asked := newBatchGeocoder(t)
+	addresses := []string{"Walterstal 101, 09599 Freiberg", "", " walterstal 101 09599  FREIBERG", "Walterstal 102, 09599 Freiberg", ""}
+	res := g.ForwardBatch(context.Background(), addresses, RequestOptions{UserId: "a"})
+	want := []error{nil, ErrEmptyQuery, nil, nil, ErrEmptyQuery}
+	for i, r := range res {
+		if r.Err != want[i] {
+			t.Errorf("result %d : err = %v, want %v", i, r.Err, want[i])
+		}
+	}
+	if res[0].Address != res[2].Address || res[0].Provider != res[2].Provider {
+		t.Errorf("results of the same address differ : %+v, %+v", res[0], res[2])
+	}
+	requests := 0
+	for _, n := range asked() {
+		requests += n
+	}
+	if requests != 2 {
+		t.Errorf("provider got %d requests, want 2", requests)
+	}
+}
+
+func TestBatchCancelled(t *testing.T) {
+	g, asked := newBatchGeocoder(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	res := g.batch(ctx, []string{"a", "b", "a", "c"}, func(i int) (Result, error) {
+		calls++
+		cancel() // the client goes away during the first lookup
+		return Result{Provider: "tomtom"}, nil
+	})
+	if calls != 1 {
+		t.Errorf("lookup called %d times, want 1", calls)
+	}
+	want := []error{nil, context.Canceled, nil, context.Canceled}
+	for i, r := range res {
+		if r.Err != want[i] {
+			t.Errorf("result %d : err = %v, want %v", i, r.Err, want[i])
+		}
+	}
+	if n := len(asked()); n != 0 {
+		t.Errorf("provider asked %d times", n)
+	}
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"math/rand"
+	"time"
+)
+
+// States of the circuit breaker of a provider.
+const (
+	BreakerClosed   = "closed"    // the provider is asked as usual
+	BreakerOpen     = "open"      // the provider failed too often and is paused until the backoff is over
+	BreakerHalfOpen = "half-open" // the backoff is over - a single trial request decides if it is closed again
+)
+
+const (
+	defaultBreakerThreshold  = 3
+	defaultBreakerBackoff    = 5 * time.Second
+	defaultBreakerMaxBackoff = time.Hour
+	// needFixBackoff is how long a provider is paused after ErrNeedFixBeforeRetry
+	needFixBackoff = time.Hour
+)
+
+// breaker is the circuit breaker of a provider - guarded by the lock of the providerState.
+type breaker struct {
+	state         string
+	failures      int // consecutive failures while closed
+	openings      int // consecutive times opened without a successful request in between
+	openUntil     time.Time
+	trialInFlight bool
+}
+
+func breakerConfig(prov *models.GeoCodeProvider) (threshold int, backoff time.Duration, maxBackoff time.Duration) {
+	threshold, backoff, maxBackoff = prov.BreakerThreshold, time.Duration(prov.BreakerBackoff), time.Duration(prov.BreakerMaxBackoff)
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if backoff <= 0 {
+		backoff = defaultBreakerBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultBreakerMaxBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return
+}
+
+// State returns the current state - an open breaker whose backoff is over is half-open.
+func (b *breaker) State(now time.Time) string {
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		return BreakerHalfOpen
+	}
+	if b.state == "" {
+		return BreakerClosed
+	}
+	return b.state
+}
+
+// allow tells if a request may be sent now. In half-open state only one trial request is allowed at a time - the
+// caller needs to report its result with success or failure.
+func (b *breaker) allow(now time.Time) bool {
+	switch b.State(now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trialInFlight = true
+	}
+	return true
+}
+
+// success closes the breaker.
+func (b *breaker) success() {
+	*b = breaker{state: BreakerClosed}
+}
+
+// failure counts a failed request and opens the breaker once there were threshold failures in a row - or right away
+// if a trial request failed.
+func (b *breaker) failure(prov *models.GeoCodeProvider, now time.Time) {
+	threshold, backoff, maxBackoff := breakerConfig(prov)
+	b.failures++
+	if b.state != BreakerHalfOpen && b.failures < threshold {
+		return
+	}
+	// exponential backoff with +-20% jitter, so providers failing together don't come back all at once
+	d := backoff
+	for i := 0; i < b.openings && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	d = time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+	b.open(now, d)
+}
+
+// open opens the breaker for d.
+func (b *breaker) open(now time.Time, d time.Duration) {
+	b.state = BreakerOpen
+	b.openings++
+	b.failures = 0
+	b.trialInFlight = false
+	b.openUntil = now.Add(d)
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestBreakerStates(t *testing.T) {
+	prov := &models.GeoCodeProvider{BreakerThreshold: 2, BreakerBackoff: int64(10 * time.Second)}
+	// the first backoff is 8 - 12 seconds with jitter, the second one 16 - 24 seconds
+	tests := []struct {
+		name  string
+		after time.Duration // time passed since the previous step
+		op    string        // allow, success or failure
+		allow bool          // result of allow
+		state string        // state after the step
+	}{
+		{"new breaker", 0, "allow", true, BreakerClosed},
+		{"1st failure", 0, "failure", false, BreakerClosed},
+		{"success resets the failures", 0, "success", false, BreakerClosed},
+		{"1st failure again", 0, "failure", false, BreakerClosed},
+		{"threshold reached", 0, "failure", false, BreakerOpen},
+		{"open", 0, "allow", false, BreakerOpen},
+		{"still open", 7 * time.Second, "allow", false, BreakerOpen},
+		{"backoff over", 6 * time.Second, "allow", true, BreakerHalfOpen},
+		{"single trial request", 0, "allow", false, BreakerHalfOpen},
+		{"trial failed", 0, "failure", false, BreakerOpen},
+		{"doubled backoff", 15 * time.Second, "allow", false, BreakerOpen},
+		{"doubled backoff over", 10 * time.Second, "allow", true, BreakerHalfOpen},
+		{"trial succeeded", 0, "success", false, BreakerClosed},
+		{"closed", 0, "allow", true, BreakerClosed},
+	}
+	var b breaker
+	now := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		switch tt.op {
+		case "allow":
+			if got := b.allow(now); got != tt.allow {
+				t.Errorf("%s : allow = %v, want %v", tt.name, got, tt.allow)
+			}
+		case "success":
+			b.success()
+		case "failure":
+			b.failure(prov, now)
+		}
+		if got := b.State(now); got != tt.state {
+			t.Errorf("%s : State = %s, want %s", tt.name, got, tt.state)
+		}
+	}
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		prov     models.GeoCodeProvider
+		openings int
+		min, max time.Duration
+	}{
+		{"default", models.GeoCodeProvider{}, 0, 4 * time.Second, 6 * time.Second},
+		{"doubled", models.GeoCodeProvider{}, 3, 32 * time.Second, 48 * time.Second},
+		{"default max", models.GeoCodeProvider{}, 20, 48 * time.Minute, 72 * time.Minute},
+		{"configured", models.GeoCodeProvider{BreakerBackoff: int64(time.Minute)}, 1, 96 * time.Second, 144 * time.Second},
+		{"configured max", models.GeoCodeProvider{BreakerBackoff: int64(time.Minute), BreakerMaxBackoff: int64(90 * time.Second)}, 2, 72 * time.Second, 108 * time.Second},
+		{"max below backoff", models.GeoCodeProvider{BreakerBackoff: int64(time.Minute), BreakerMaxBackoff: int64(time.Second)}, 2, 48 * time.Second, 72 * time.Second},
+	}
+	now := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			// a failed trial request opens the breaker right away
+			b := breaker{state: BreakerHalfOpen, openings: tt.openings}
+			b.failure(&tt.prov, now)
+			if d := b.openUntil.Sub(now); d < tt.min || d > tt.max {
+				t.Errorf("%s : opened for %v, want %v - %v", tt.name, d, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
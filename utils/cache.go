@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a single resolved address stored in a cache.
+type CacheEntry struct {
+	Address  models.Address
+	Provider string  // name of the provider the address is from
+	Time     int64   // UnixNano when the address was resolved
+	Lat      float64 // coordinates that were asked for - reverse lookups only
+	Lng      float64 // coordinates that were asked for - reverse lookups only
+}
+
+// CacheStats are the counters of a cache.
+type CacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+// ResultCache stores resolved addresses by the keys from ReverseCacheKey & ForwardCacheKey.
+// Implementations need to be safe for concurrent use.
+type ResultCache interface {
+	// Get returns the entry for key, if it exists and did not expire yet.
+	Get(key string) (CacheEntry, bool)
+	// Put adds or replaces the entry for key.
+	Put(key string, e CacheEntry)
+	// Stats returns the hit & miss counters and the current number of entries.
+	Stats() CacheStats
+}
+
+// TieredCache asks a fast cache (usually a MemoryCache) first and a slow one (usually a DiskCache) if the fast one
+// misses. Entries found in the slow cache are copied to the fast one.
+type TieredCache struct {
+	Fast ResultCache
+	Slow ResultCache
+}
+
+func (c TieredCache) Get(key string) (e CacheEntry, ok bool) {
+	e, ok = c.Fast.Get(key)
+	if ok {
+		return
+	}
+	e, ok = c.Slow.Get(key)
+	if ok {
+		c.Fast.Put(key, e)
+	}
+	return
+}
+
+func (c TieredCache) Put(key string, e CacheEntry) {
+	c.Fast.Put(key, e)
+	c.Slow.Put(key, e)
+}
+
+// Stats returns the hits of both caches, the misses of the slow cache (= requests neither of them could answer)
+// and the entries of the slow cache.
+func (c TieredCache) Stats() CacheStats {
+	fast := c.Fast.Stats()
+	slow := c.Slow.Stats()
+	return CacheStats{Hits: fast.Hits + slow.Hits, Misses: slow.Misses, Entries: slow.Entries}
+}
+
+// MemoryCache is a bounded in-memory LRU cache of resolved addresses. It is safe for concurrent use.
+type MemoryCache struct {
+	mu     sync.Mutex
+	size   int
+	ttl    time.Duration
+	now    func() time.Time
+	ll     *list.List // most recently used first, values are *memoryCacheItem
+	items  map[string]*list.Element
+	hits   int64
+	misses int64
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry CacheEntry
+}
+
+// NewMemoryCache creates a cache holding at most size entries. Entries older than ttl are not returned anymore,
+// ttl = 0 means they never expire. now is the clock used for expiry, nil means time.Now.
+func NewMemoryCache(size int, ttl time.Duration, now func() time.Time) *MemoryCache {
+	if now == nil {
+		now = time.Now
+	}
+	return &MemoryCache{
+		size:  size,
+		ttl:   ttl,
+		now:   now,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry for key, if it exists and did not expire yet.
+func (c *MemoryCache) Get(key string) (e CacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.items[key]
+	if el != nil {
+		item := el.Value.(*memoryCacheItem)
+		if c.ttl == 0 || c.now().Sub(time.Unix(0, item.entry.Time)) < c.ttl {
+			c.ll.MoveToFront(el)
+			c.hits++
+			return item.entry, true
+		}
+		c.removeElement(el)
+	}
+	c.misses++
+	return
+}
+
+// Put adds or replaces the entry for key, evicting the least recently used entry if the cache is full.
+func (c *MemoryCache) Put(key string, e CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.items[key]; el != nil {
+		el.Value.(*memoryCacheItem).entry = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&memoryCacheItem{key: key, entry: e})
+	for c.size > 0 && c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *MemoryCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*memoryCacheItem).key)
+}
+
+// Stats returns the hit & miss counters and the current number of entries.
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: c.ll.Len()}
+}
+
+// metresPerDegree is the length of one degree latitude (and longitude at the equator).
+const metresPerDegree = 111320.0
+
+// ReverseCacheKey returns the cache key for the given coordinates, rounded to a grid of precision metres.
+func ReverseCacheKey(lat float64, lng float64, precision float64) string {
+	if precision <= 0 {
+		return fmt.Sprintf("r|%f|%f", lat, lng)
+	}
+	latStep := precision / metresPerDegree
+	y := math.Floor(lat/latStep + 0.5)
+	// use the latitude of the grid row, so all points in a cell get the same longitude step
+	lngStep := precision / (metresPerDegree * math.Max(math.Cos(y*latStep*math.Pi/180), 0.01))
+	x := math.Floor(lng/lngStep + 0.5)
+	return fmt.Sprintf("r|%g|%d|%d", precision, int64(y), int64(x))
+}
+
+// ForwardCacheKey returns the cache key for the given address - case, commas and whitespace are ignored.
+func ForwardCacheKey(s string) string {
+	s = strings.ToLower(strings.Replace(s, ",", " ", -1))
+	return "f|" + strings.Join(strings.Fields(s), " ")
+}
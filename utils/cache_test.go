@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestForwardCacheKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Walterstal 101, 09599 Freiberg", "walterstal 101 09599 freiberg", true},
+		{"  Walterstal   101,09599 Freiberg ", "Walterstal 101, 09599 Freiberg", true},
+		{"Walterstal 101, 09599 Freiberg", "Walterstal 102, 09599 Freiberg", false},
+	}
+	for _, tt := range tests {
+		if got := ForwardCacheKey(tt.a) == ForwardCacheKey(tt.b); got != tt.same {
+			t.Errorf("ForwardCacheKey(%q) == ForwardCacheKey(%q) is %v, want %v", tt.a, tt.b, got, tt.same)
+		}
+	}
+}
+
+func TestReverseCacheKey(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		precision              float64
+		same                   bool
+	}{
+		{"same point", 50.910950, 13.323350, 50.910950, 13.323350, 10, true},
+		{"1 metre apart", 50.910950, 13.323350, 50.910959, 13.323350, 10, true},
+		{"100 metres apart", 50.910950, 13.323350, 50.911850, 13.323350, 10, false},
+		{"no grid", 50.910950, 13.323350, 50.910959, 13.323350, 0, false},
+	}
+	for _, tt := range tests {
+		got := ReverseCacheKey(tt.lat1, tt.lng1, tt.precision) == ReverseCacheKey(tt.lat2, tt.lng2, tt.precision)
+		if got != tt.same {
+			t.Errorf("%s : same key is %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewMemoryCache(2, 0, nil)
+	c.Put("a", CacheEntry{Provider: "a"})
+	c.Put("b", CacheEntry{Provider: "b"})
+	c.Get("a") // b is the least recently used now
+	c.Put("c", CacheEntry{Provider: "c"})
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Get(%s) found %v, want %v", key, ok, want)
+		}
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Hits != 3 || s.Misses != 1 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewMemoryCache(10, time.Hour, func() time.Time { return now })
+	c.Put("a", CacheEntry{Time: now.UnixNano()})
+	now = now.Add(59 * time.Minute)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("entry expired too early")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entry returned")
+	}
+	if s := c.Stats(); s.Entries != 0 {
+		t.Errorf("expired entry kept : %+v", s)
+	}
+}
+
+func TestGeocoderCachesResults(t *testing.T) {
+	var received int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	g, _ := NewGeocoder(Options{CacheSize: 10, Providers: []*models.GeoCodeProvider{
+		{Name: "tomtom", TypeName: "tomtom", Uri: srv.URL, IntervalSizeInDays: 1},
+	}})
+
+	res, err := g.Reverse(context.Background(), 50.910950, 13.323350, RequestOptions{UserId: "a"})
+	if err != nil || res.FromCache {
+		t.Fatalf("first lookup : %+v, %v", res, err)
+	}
+	// a few metres away - same cell of the cache grid
+	res, err = g.Reverse(context.Background(), 50.910952, 13.323352, RequestOptions{UserId: "b"})
+	if err != nil || !res.FromCache || res.Provider != "tomtom" || res.Address.Street != "Walterstal" {
+		t.Fatalf("second lookup : %+v, %v", res, err)
+	}
+	if received != 1 {
+		t.Errorf("provider got %d requests, want 1", received)
+	}
+	if _, _, _, used := g.RequestCounts("b"); used != 0 {
+		t.Errorf("cached lookup counted for the user : %d", used)
+	}
+}
+
+func TestCachedResultsRespectAccess(t *testing.T) {
+	tomtom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer tomtom.Close()
+	osm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"lat":"50.9","lon":"13.3","display_name":"Walterstal 101, Freiberg","address":{"house_number":"101","road":"Walterstal","town":"Freiberg","postcode":"09599","country_code":"de"}}`)
+	}))
+	defer osm.Close()
+	g, _ := NewGeocoder(Options{CacheSize: 10, NearbyRadius: 25, Providers: []*models.GeoCodeProvider{
+		{Name: "tomtom", TypeName: "tomtom", Uri: tomtom.URL, IntervalSizeInDays: 1},
+		{Name: "osm", TypeName: "nominatim", Uri: osm.URL, IntervalSizeInDays: 1},
+	}})
+	err := g.SetPlans(PlanConfig{
+		Plans: []Plan{{Name: "free", Providers: []string{"osm"}}, {Name: "pro", Providers: []string{"tomtom"}}},
+		Users: map[string]string{"f": "free", "p": "pro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := g.Reverse(context.Background(), 50.910950, 13.323350, RequestOptions{UserId: "p"})
+	if err != nil || res.Provider != "tomtom" {
+		t.Fatalf("lookup of the pro user : %+v, %v", res, err)
+	}
+	// a point 20 metres away & the same point - both only cached from tomtom, which the free user may not use
+	for _, lng := range []float64{13.323635, 13.323350} {
+		res, err = g.Reverse(context.Background(), 50.910950, lng, RequestOptions{UserId: "f"})
+		if err != nil || res.FromCache || res.Provider != "osm" {
+			t.Errorf("lookup of the free user at %f : %+v, %v", lng, res, err)
+		}
+	}
+	res, err = g.Reverse(context.Background(), 50.910950, 13.323350, RequestOptions{UserId: "f"})
+	if err != nil || !res.FromCache || res.Provider != "osm" {
+		t.Errorf("second lookup of the free user : %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// coalescedCall is a lookup in flight - every caller with the same key waits for it instead of asking the providers again.
+type coalescedCall struct {
+	done      chan struct{}
+	res       Result
+	err       error
+	abandoned bool // the caller of the lookup gave up before it finished
+}
+
+// coalescer makes sure there is only one lookup in flight per key. It is safe for concurrent use.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do calls fn, unless a call for the same key is already in flight - then it waits for that call and returns its
+// result. shared tells if the result came from another call. Waiting stops once ctx is done. If the other call was
+// cancelled by its own caller, fn is called again.
+func (c *coalescer) do(ctx context.Context, key string, fn func() (Result, error)) (res Result, err error, shared bool) {
+	for {
+		c.mu.Lock()
+		if c.calls == nil {
+			c.calls = make(map[string]*coalescedCall)
+		}
+		call := c.calls[key]
+		if call == nil {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return res, ctx.Err(), false
+		}
+		if call.abandoned && ctx.Err() == nil {
+			continue
+		}
+		return call.res, call.err, true
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.res, call.err = fn()
+	call.abandoned = ctx.Err() != nil
+	return call.res, call.err, false
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesCall(t *testing.T) {
+	var c coalescer
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go c.do(context.Background(), "k", func() (Result, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return Result{Provider: "leader"}, nil
+	})
+	<-started
+
+	const followers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < followers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err, shared := c.do(context.Background(), "k", func() (Result, error) {
+				atomic.AddInt32(&calls, 1)
+				return Result{Provider: "follower"}, nil
+			})
+			if err != nil || !shared || res.Provider != "leader" {
+				t.Errorf("follower %d : %+v, %v, shared %v", i, res, err, shared)
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond) // let the followers wait for the leader
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	// the key is free again once the call finished
+	if res, _, shared := c.do(context.Background(), "k", func() (Result, error) { return Result{Provider: "next"}, nil }); shared || res.Provider != "next" {
+		t.Errorf("call after the leader finished : %+v, shared %v", res, shared)
+	}
+}
+
+func TestCoalescerLeaderCancelled(t *testing.T) {
+	var c coalescer
+	started := make(chan struct{})
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	go c.do(leaderCtx, "k", func() (Result, error) {
+		close(started)
+		<-leaderCtx.Done()
+		return Result{}, leaderCtx.Err()
+	})
+	<-started
+
+	type outcome struct {
+		res    Result
+		err    error
+		shared bool
+	}
+	follower := make(chan outcome)
+	go func() {
+		res, err, shared := c.do(context.Background(), "k", func() (Result, error) { return Result{Provider: "follower"}, nil })
+		follower <- outcome{res, err, shared}
+	}()
+	// a follower that gives up itself gets its own error, not the one of the leader
+	impatientCtx, cancelImpatient := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelImpatient()
+	if _, err, _ := c.do(impatientCtx, "k", func() (Result, error) { return Result{}, errors.New("called") }); err != context.DeadlineExceeded {
+		t.Errorf("impatient follower : err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	cancelLeader()
+	o := <-follower
+	if o.err != nil || o.shared || o.res.Provider != "follower" {
+		t.Errorf("follower after the leader was cancelled : %+v, want its own lookup", o)
+	}
+}
+
+// TestCoalescedLookupLeaderCancelled cancels the request of a user while another one waits for the same lookup - the
+// waiting user has to get an address anyway.
+func TestCoalescedLookupLeaderCancelled(t *testing.T) {
+	var received int32
+	asked := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&received, 1) == 1 {
+			close(asked)
+			<-r.Context().Done() // the first request hangs until its caller gives up
+			return
+		}
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	g, err := NewGeocoder(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"tomtom","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1}]`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := g.Reverse(ctx, 50.910950, 13.323350, RequestOptions{UserId: "a"})
+		leader <- err
+	}()
+	<-asked
+	follower := make(chan error)
+	go func() {
+		res, err := g.Reverse(context.Background(), 50.910950, 13.323350, RequestOptions{UserId: "b"})
+		if err == nil && res.Address.Street != "Walterstal" {
+			err = fmt.Errorf("got %+v", res)
+		}
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the follower wait for the lookup of a
+	cancel()
+
+	if err = <-leader; err != context.Canceled {
+		t.Errorf("cancelled lookup : err = %v, want %v", err, context.Canceled)
+	}
+	if err = <-follower; err != nil {
+		t.Errorf("waiting lookup : %v", err)
+	}
+	if received != 2 {
+		t.Errorf("provider got %d requests, want 2", received)
+	}
+}
@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+func TestCountryAlpha2(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"DEU", "DE"},
+		{"deu", "DE"},
+		{"de", "DE"},
+		{"AUT", "AT"},
+		{"GBR", "GB"},
+		{"", ""},
+		{"XYZ", "XYZ"},
+	}
+	for _, tt := range tests {
+		if got := countryAlpha2(tt.code); got != tt.want {
+			t.Errorf("countryAlpha2(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
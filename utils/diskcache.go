@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"sync"
+	"time"
+)
+
+var diskCacheEntriesBucket = []byte("entries") // key -> json encoded CacheEntry
+var diskCacheTimesBucket = []byte("times")     // 8 byte big endian CacheEntry.Time + key -> nothing, used for eviction & expiry
+
+// DiskCache is a persistent cache of resolved addresses in a single bolt database file, so we don't spend our
+// contingents again on locations we already resolved before a restart. It is safe for concurrent use.
+type DiskCache struct {
+	// mu is held exclusively while compacting, as the database file gets replaced.
+	mu         sync.RWMutex
+	path       string
+	db         *bolt.DB
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	statsMu sync.Mutex
+	entries int
+	hits    int64
+	misses  int64
+}
+
+// OpenDiskCache opens or creates the cache database at path. If maxEntries > 0, the oldest entries are evicted when
+// the cache grows bigger. Entries older than ttl are not returned anymore and removed on Compact, ttl = 0 means they
+// never expire. now is the clock used for expiry, nil means time.Now.
+func OpenDiskCache(path string, maxEntries int, ttl time.Duration, now func() time.Time) (c *DiskCache, err error) {
+	if now == nil {
+		now = time.Now
+	}
+	c = &DiskCache{
+		path:       path,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        now,
+	}
+	err = c.open()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *DiskCache) open() (err error) {
+	c.db, err = bolt.Open(c.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(diskCacheEntriesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(diskCacheTimesBucket)
+		if err != nil {
+			return err
+		}
+		c.statsMu.Lock()
+		c.entries = b.Stats().KeyN
+		c.statsMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		c.db.Close()
+	}
+	return
+}
+
+func (c *DiskCache) expired(e *CacheEntry) bool {
+	return c.ttl != 0 && c.now().Sub(time.Unix(0, e.Time)) >= c.ttl
+}
+
+func diskCacheTimeKey(t int64, key string) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(t))
+	copy(k[8:], key)
+	return k
+}
+
+// Get returns the entry for key, if it exists and did not expire yet.
+func (c *DiskCache) Get(key string) (e CacheEntry, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(diskCacheEntriesBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		if json.Unmarshal(v, &e) == nil && !c.expired(&e) {
+			ok = true
+		}
+		return nil
+	})
+	c.statsMu.Lock()
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.statsMu.Unlock()
+	return
+}
+
+// Put adds or replaces the entry for key, evicting the oldest entries if the cache is full.
+func (c *DiskCache) Put(key string, e CacheEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(diskCacheEntriesBucket)
+		times := tx.Bucket(diskCacheTimesBucket)
+		added := 1
+		if old := entries.Get([]byte(key)); old != nil {
+			var oldEntry CacheEntry
+			if json.Unmarshal(old, &oldEntry) == nil {
+				times.Delete(diskCacheTimeKey(oldEntry.Time, key))
+			}
+			added = 0
+		}
+		if err := entries.Put([]byte(key), data); err != nil {
+			return err
+		}
+		if err := times.Put(diskCacheTimeKey(e.Time, key), nil); err != nil {
+			return err
+		}
+		c.statsMu.Lock()
+		c.entries += added
+		evict := 0
+		if c.maxEntries > 0 && c.entries > c.maxEntries {
+			evict = c.entries - c.maxEntries
+		}
+		c.statsMu.Unlock()
+		if evict > 0 {
+			evicted := c.removeOldest(entries, times, evict, 0)
+			c.statsMu.Lock()
+			c.entries -= evicted
+			c.statsMu.Unlock()
+		}
+		return nil
+	})
+}
+
+// removeOldest removes up to n of the oldest entries (n = 0 means no limit) or all entries older than before
+// (before = 0 means no limit) and returns the number of removed entries.
+func (c *DiskCache) removeOldest(entries *bolt.Bucket, times *bolt.Bucket, n int, before int64) (removed int) {
+	cur := times.Cursor()
+	for k, _ := cur.First(); k != nil && len(k) >= 8; k, _ = cur.First() {
+		if n > 0 && removed >= n {
+			break
+		}
+		if before > 0 && int64(binary.BigEndian.Uint64(k[:8])) >= before {
+			break
+		}
+		entries.Delete(k[8:])
+		cur.Delete()
+		removed++
+	}
+	return
+}
+
+// Expire removes all entries older than the ttl.
+func (c *DiskCache) Expire() (err error) {
+	if c.ttl == 0 {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db.Update(func(tx *bolt.Tx) error {
+		removed := c.removeOldest(tx.Bucket(diskCacheEntriesBucket), tx.Bucket(diskCacheTimesBucket), 0, c.now().Add(-c.ttl).UnixNano())
+		c.statsMu.Lock()
+		c.entries -= removed
+		c.statsMu.Unlock()
+		return nil
+	})
+}
+
+// Compact removes expired entries and rewrites the database file, so space of removed entries is given back to the
+// file system. Requests wait while compacting.
+func (c *DiskCache) Compact() (err error) {
+	err = c.Expire()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tmpPath := c.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	err = c.db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{diskCacheEntriesBucket, diskCacheTimesBucket} {
+				b, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				// keys are copied in order, so fill the pages completely
+				b.FillPercent = 1
+				err = src.Bucket(name).ForEach(func(k, v []byte) error {
+					return b.Put(k, v)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	dst.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	err = c.db.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	// reopen in any case - if renaming failed, we continue with the old file
+	if _err := c.open(); _err != nil {
+		err = _err
+	}
+	return
+}
+
+// Stats returns the hit & miss counters and the current number of entries.
+func (c *DiskCache) Stats() CacheStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: c.entries}
+}
+
+// Close closes the database file.
+func (c *DiskCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Close()
+}
+
+// ForEach calls fn for all entries that did not expire yet.
+func (c *DiskCache) ForEach(fn func(key string, e CacheEntry)) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskCacheEntriesBucket).ForEach(func(k, v []byte) error {
+			var e CacheEntry
+			if json.Unmarshal(v, &e) == nil && !c.expired(&e) {
+				fn(string(k), e)
+			}
+			return nil
+		})
+	})
+}
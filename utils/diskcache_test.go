@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheEvictsOldest(t *testing.T) {
+	c, err := OpenDiskCache(filepath.Join(t.TempDir(), "cache.db"), 2, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Put("a", CacheEntry{Provider: "a", Time: 1})
+	c.Put("b", CacheEntry{Provider: "b", Time: 2})
+	c.Put("a", CacheEntry{Provider: "a", Time: 3}) // replaced, so b is the oldest now
+	c.Put("c", CacheEntry{Provider: "c", Time: 4})
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Get(%s) found %v, want %v", key, ok, want)
+		}
+	}
+	if s := c.Stats(); s.Entries != 2 {
+		t.Errorf("Stats() = %+v, want 2 entries", s)
+	}
+}
+
+func TestDiskCacheExpiresAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	c, err := OpenDiskCache(path, 0, time.Hour, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("old", CacheEntry{Provider: "old", Time: now.UnixNano()})
+	now = now.Add(30 * time.Minute)
+	c.Put("new", CacheEntry{Provider: "new", Time: now.UnixNano()})
+	now = now.Add(45 * time.Minute)
+	if _, ok := c.Get("old"); ok {
+		t.Error("expired entry returned")
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 1 {
+		t.Errorf("Stats() after Compact = %+v, want 1 entry", s)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenDiskCache(path, 0, time.Hour, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if e, ok := c.Get("new"); !ok || e.Provider != "new" {
+		t.Errorf("Get(new) after reopening = %+v, %v", e, ok)
+	}
+	if s := c.Stats(); s.Entries != 1 {
+		t.Errorf("Stats() after reopening = %+v, want 1 entry", s)
+	}
+}
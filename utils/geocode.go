@@ -1,20 +1,16 @@
 package utils
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/Compufreak345/dbg"
 	"github.com/OpenDriversLog/odl-geocoder/models"
 	"io/ioutil"
 	"net/http"
 	"sort"
-	"strconv"
-	"time"
-	"net/url"
-	"os"
 	"strings"
-	"regexp"
+	"sync"
+	"time"
 )
 
 const TAG = "og/geocode.go"
@@ -25,273 +21,467 @@ var ErrNoRequestsLeft = errors.New("All geocoders contingent is used up!")
 var ErrNeedFixBeforeRetry = errors.New("Need fix before retrying!")
 var ErrSkipProvider = errors.New("Skip this provider")
 var ErrProviderNotSupported = errors.New("Provider not supported!")
-var MaxRequestsPerDay int
-var MaxRequestsPerUser int
-var CurDailyRequestsUsed int
-var CurRequestsByUserUsed map[string]int
+
+// Debug enables logging of requests & responses.
 var Debug bool
-var client = &http.Client{
-	Timeout: time.Duration(5 * time.Second),
+
+// providerState wraps a configured provider together with the lock guarding it. The name never changes, every other
+// field of prov may only be accessed while holding the lock.
+type providerState struct {
+	sync.Mutex
+	name    string
+	prov    *models.GeoCodeProvider
+	stats   providerStats
+	breaker breaker
 }
-var ChainProviders []*models.GeoCodeProvider
-var NonChainProviders []*models.GeoCodeProvider
-var AllProviders []*models.GeoCodeProvider
-// Did anything change since we last saved the request counts?
-var ChangesSinceLastSave bool
-// used for sorting providers by lowest next allowed request time - ascending
-type ByNextTime []*models.GeoCodeProvider
-
-func (a ByNextTime) Len() int      { return len(a) }
-func (a ByNextTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByNextTime) Less(i, j int) bool {
-	return a[i].NextAllowedRequestTime < a[j].NextAllowedRequestTime
+
+// providerStats are the counters of a provider since the start - guarded by the lock of the providerState.
+type providerStats struct {
+	successes     int64
+	empty         int64
+	errors        int64
+	skips         int64
+	lastError     string
+	lastErrorTime time.Time
+	lastLatency   time.Duration
+}
+
+// providerSortEntry holds the values a provider is sorted by, read once while holding its lock.
+type providerSortEntry struct {
+	p               *providerState
+	hasRequestsLeft bool
+	priority        int
+	nextAllowed     int64
 }
 
 // used for sorting providers so the one with more than 1 left request (or 0 requests done) is first.
 // But, if we already waited for the complete interval since the server was full it will be moved to top again.
-type ByReqsFull []*models.GeoCodeProvider
+// Within those, the provider with the highest prio is first, then the one with the lowest next allowed request time.
+type byAvailability []providerSortEntry
+
+func (a byAvailability) Len() int      { return len(a) }
+func (a byAvailability) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byAvailability) Less(i, j int) bool {
+	if a[i].hasRequestsLeft != a[j].hasRequestsLeft {
+		return a[i].hasRequestsLeft
+	}
+	if a[i].priority != a[j].priority {
+		return a[i].priority > a[j].priority
+	}
+	return a[i].nextAllowed < a[j].nextAllowed
+}
 
-func (a ByReqsFull) Len() int      { return len(a) }
-func (a ByReqsFull) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByReqsFull) Less(i, j int) bool {
-	return CheckIfProviderHasRequestsLeft(a[i]) && !CheckIfProviderHasRequestsLeft(a[j])
+// providerList returns the providers to use - the caller needs to hold providersMu.
+func (g *Geocoder) providerList(dontChain bool) []*providerState {
+	if dontChain {
+		return g.nonChainProviders
+	}
+	return g.chainProviders
 }
 
-// used for sorting providers by priority - descending
-type ByPrio []*models.GeoCodeProvider
+// sortedProviders returns a sorted copy of the providers the user may use - the shared lists are never reordered.
+func (g *Geocoder) sortedProviders(dontChain bool, access userAccess) []*providerState {
+	now := g.now().UnixNano()
+	g.providersMu.RLock()
+	available := g.providerList(dontChain)
+	entries := make([]providerSortEntry, 0, len(available))
+	for _, v := range available {
+		v.Lock()
+		if access.allows(v.name, v.prov) {
+			entries = append(entries, providerSortEntry{
+				p:               v,
+				hasRequestsLeft: CheckIfProviderHasRequestsLeft(v.prov, now),
+				priority:        v.prov.Priority,
+				nextAllowed:     v.prov.NextAllowedRequestTime,
+			})
+		}
+		v.Unlock()
+	}
+	g.providersMu.RUnlock()
+
+	sort.Stable(byAvailability(entries))
+	res := make([]*providerState, len(entries))
+	for i, e := range entries {
+		res[i] = e.p
+	}
+	return res
+}
 
-func (a ByPrio) Len() int      { return len(a) }
-func (a ByPrio) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByPrio) Less(i, j int) bool {
-	return a[i].Priority > a[j].Priority
+// providerCount are the limits & usage of a single provider, as of the last recalcRequestCounts.
+type providerCount struct {
+	name            string
+	maxPerDay       int
+	curDailyUsed    int
+	maxPerUser      int
+	usersToReqCount map[string]int
+	access          models.GeoCodeProvider // only the allow & deny lists are set
 }
 
 // func CheckIfProviderHasRequestsLeft checks if the given provider has more than 1 request remaining, or first interval request is
 // more than the IntervalSize ago. (We use nextAllowedRequest as if it was lastRequest, because it is usually not more than
 // an hour off)
-func CheckIfProviderHasRequestsLeft(provider *models.GeoCodeProvider) bool {
+// now is the current time as UnixNano, the caller needs to hold the lock of the provider.
+func CheckIfProviderHasRequestsLeft(provider *models.GeoCodeProvider, now int64) bool {
 	if provider.FirstIntervalRequest == 0 {
-		provider.FirstIntervalRequest = time.Now().UnixNano()
+		provider.FirstIntervalRequest = now
 	}
 	return provider.MaxRequestsPerInterval-provider.CurIntervalRequests > 1 ||
-	provider.CurIntervalRequests == 0 || provider.MaxRequestsPerInterval==0 ||
-	provider.FirstIntervalRequest+60*60*24*1000*1000*1000*int64(provider.IntervalSizeInDays) < time.Now().UnixNano()
+		provider.CurIntervalRequests == 0 || provider.MaxRequestsPerInterval == 0 ||
+		intervalEnd(provider) < now
 }
-func ReverseGeocode(lat float64, lng float64, dontChain bool, uId string) (res models.Address,usedProvider *models.GeoCodeProvider, err error) {
-	success := false
-	var availableProviders []*models.GeoCodeProvider
-	if dontChain {
-		availableProviders = NonChainProviders
-	} else {
-		availableProviders = ChainProviders
+
+// intervalEnd returns when the current request interval of the provider ends (UnixNano) - IntervalSizeInDays after
+// its first request, or at the start of the next month (UTC) for IntervalMonthly providers.
+func intervalEnd(provider *models.GeoCodeProvider) int64 {
+	if provider.IntervalMonthly {
+		t := time.Unix(0, provider.FirstIntervalRequest).UTC()
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
 	}
-	// First try = the provider with the lowest next allowed request time
-	sort.Sort(ByNextTime(availableProviders))
-	// First try = the provider with the highest prio
-	sort.Sort(ByPrio(availableProviders))
-	// But only if there is more than one request left (=try full request servers last to see if the interval-time has passed and new requests are available)
-	sort.Sort(ByReqsFull(availableProviders))
+	return provider.FirstIntervalRequest + 24*60*60*1000*1000*1000*int64(provider.IntervalSizeInDays)
+}
 
-	var tempRes models.Address
-	for _, v := range availableProviders {
-		if v.UsersToReqCount == nil {
-			v.UsersToReqCount = make(map[string]int)
-		}
-		tempRes, err = ReverseGeocodeForProvider(lat, lng, v, uId, false)
-		if v.CurIntervalRequests == 1 {
-			v.FirstIntervalRequest = time.Now().UnixNano()
-		}
-		if err != nil {
-			if err == ErrNeedFixBeforeRetry {
-				dbg.E(TAG, "Error needing fix for geocode provider %s %s (type %d): ", v.Uri, v.Name, v.Type, err)
-				v.NextAllowedRequestTime = time.Now().UnixNano() + 60*60*1000*1000*1000
+// resetUserCountsDaily forgets the requests per user once the UTC day they were counted on is over - independent of
+// the request interval of the provider, which may be a whole month. The caller needs to hold the lock of the provider.
+func resetUserCountsDaily(provider *models.GeoCodeProvider, now int64) {
+	day := time.Unix(0, now).UTC().Format("2006-01-02")
+	if provider.UsersToReqCountDay != day {
+		provider.UsersToReqCount = make(map[string]int)
+		provider.UsersToReqCountDay = day
+	}
+}
 
-			} else if err == ErrSkipProvider {
-				err = nil
-				continue
-			} else if err == ErrEmptyResult {
-				dbg.W(TAG,"Geocoder returned 0 results")
-				if v.Type ==2 { // our chain providers already tried all geocoding providers - no sense in trying another
-					break;
-				}
-				continue;
-			} else {
-				dbg.E(TAG, "Error for geocode provider %s %s (type %d): ", v.Uri, v.Name, v.Type, err)
-				v.NextAllowedRequestTime = time.Now().UnixNano() + 5*1000*1000*1000
+// intervalDays returns the length of the current request interval of the provider in days.
+func intervalDays(provider *models.GeoCodeProvider) int {
+	if provider.IntervalMonthly {
+		t := time.Unix(0, provider.FirstIntervalRequest).UTC()
+		return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	}
+	return provider.IntervalSizeInDays
+}
+
+// cacheKey returns the key results for q are cached with.
+func (g *Geocoder) cacheKey(q *Query, isReverse bool) string {
+	if isReverse {
+		return ReverseCacheKey(q.Lat, q.Lng, g.cachePrecision)
+	}
+	key := ForwardCacheKey(q.Address)
+	if q.Country != "" {
+		key += "|" + strings.ToLower(q.Country)
+	}
+	if q.Focus != nil {
+		// results only differ noticeably for focus points some kilometres apart
+		key += fmt.Sprintf("|%.2f,%.2f", q.Focus.Lat, q.Focus.Lng)
+	}
+	return key
+}
+
+// geocode returns the cached address for q, or walks through the available providers until one of them returns
+// a complete address. Concurrent lookups for the same cache key wait for the first one instead of asking the providers.
+func (g *Geocoder) geocode(ctx context.Context, q *Query, dontChain bool, isReverse bool) (res Result, err error) {
+	key := g.cacheKey(q, isReverse)
+	if g.cache != nil {
+		// cached addresses are shared by all users - but only served to those that may use the provider they came from
+		access := g.accessOf(q.UserId)
+		if e, ok := g.cache.Get(key); ok && g.mayServe(e.Provider, dontChain, access) {
+			res = Result{Address: e.Address, Provider: e.Provider, FromCache: true}
+			if isReverse && (e.Lat != 0 || e.Lng != 0) {
+				res.Distance = Distance(q.Lat, q.Lng, e.Lat, e.Lng)
 			}
-			continue
+			g.observer.CacheLookup(CacheHit)
+			return
 		}
-
-		usedProvider = v
-		dbg.I(TAG, "Provider %s %s (type %d) has used %d of %d requests", v.Uri, v.Name, v.Type, v.CurIntervalRequests, v.MaxRequestsPerInterval)
-		success = true
-		if tempRes.HouseNumber == "" || tempRes.Street == "" || tempRes.City == "" {
-			if res.City == "" && tempRes.City !=""{
-				res = tempRes
-			} else if res.Street == "" && tempRes.Street !=""{
-				res = tempRes
+		if isReverse && g.spatial != nil {
+			var ok bool
+			res, ok = g.nearbyFromCache(q)
+			if ok && g.mayServe(res.Provider, dontChain, access) {
+				g.observer.CacheLookup(CacheNearby)
+				return
 			}
-			if v.Type !=2 { //2=chain provider = last where we could get a better result
-				// see if we can find anything better with another provider
-				continue
+		}
+		g.observer.CacheLookup(CacheMiss)
+	}
+	// every caller is checked & charged against its own plan, also if it shares the walk of another caller
+	reservedAt := g.now()
+	plan, hasPlan, err := g.checkPlan(q.UserId, reservedAt)
+	if err != nil {
+		return
+	}
+	access := userAccess{uId: q.UserId, plan: plan, hasPlan: hasPlan}
+	defer func() {
+		if err != nil && !res.sent { // no provider was reached
+			g.releasePlanRequest(q.UserId, reservedAt)
+		}
+	}()
+	// concurrent identical lookups of users that may use the same providers share one walk through the providers
+	inFlightKey := key + "|chain"
+	if dontChain {
+		inFlightKey = key + "|dontChain"
+	}
+	inFlightKey += "|" + g.accessKey(dontChain, access)
+	res, err, _ = g.inFlight.do(ctx, inFlightKey, func() (res Result, err error) {
+		res, err = g.geocodeWithProviders(ctx, q, dontChain, isReverse, access)
+		if err == nil && g.cache != nil && !res.NoCache {
+			e := CacheEntry{Address: res.Address, Provider: res.Provider, Time: g.now().UnixNano()}
+			if isReverse {
+				e.Lat = q.Lat
+				e.Lng = q.Lng
+			}
+			g.cache.Put(key, e)
+			if isReverse && g.spatial != nil {
+				g.spatial.Insert(key, q.Lat, q.Lng)
 			}
-		} else {
-			res = tempRes
 		}
+		return
+	})
+	return
+}
 
-		break
-
+// mayServe tells if a cached address of the provider with the given name may be served to the user. Addresses of
+// providers that are not configured anymore are only checked against the plan of the user.
+func (g *Geocoder) mayServe(name string, dontChain bool, access userAccess) bool {
+	if name == "" {
+		return true
 	}
-	if !success {
-		if err != ErrEmptyResult {
-			err = ErrNoRequestsLeft
+	g.providersMu.RLock()
+	defer g.providersMu.RUnlock()
+	for _, v := range g.allProviders {
+		if v.name != name {
+			continue
 		}
-	} else {
-		err = nil
+		v.Lock()
+		defer v.Unlock()
+		if dontChain && IsChainProvider(v.prov) {
+			// another odl-geocoder asked us - it only gets what a lookup without the chained odl-geocoders would return
+			return false
+		}
+		return access.allows(v.name, v.prov)
 	}
-	RecalcRequestCounts(dontChain)
-
-	return
+	return access.allows(name, &models.GeoCodeProvider{})
 }
 
+// accessKey lists the providers the user may use, so lookups are only shared between users that may use the same ones.
+func (g *Geocoder) accessKey(dontChain bool, access userAccess) string {
+	var names []string
+	g.providersMu.RLock()
+	for _, v := range g.providerList(dontChain) {
+		v.Lock()
+		if access.allows(v.name, v.prov) {
+			names = append(names, v.name)
+		}
+		v.Unlock()
+	}
+	g.providersMu.RUnlock()
+	return strings.Join(names, ",")
+}
 
-func Geocode(s string, dontChain bool, uId string) (res models.Address,usedProvider *models.GeoCodeProvider, err error) {
-	success := false
-	var availableProviders []*models.GeoCodeProvider
-	if dontChain {
-		availableProviders = NonChainProviders
-	} else {
-		availableProviders = ChainProviders
+// nearbyFromCache returns the cached address of the closest reverse lookup within nearbyRadius.
+func (g *Geocoder) nearbyFromCache(q *Query) (res Result, ok bool) {
+	key, dist, ok := g.spatial.Nearest(q.Lat, q.Lng, g.nearbyRadius)
+	if !ok {
+		return
 	}
-	// First try = the request with the lowest next allowed request time
-	sort.Sort(ByNextTime(availableProviders))
-	// First try = the provider with the highest prio
-	sort.Sort(ByPrio(availableProviders))
-	// But only if there is more than one request left (=try full request servers last to see if the interval-time has passed and new requests are available)
-	sort.Sort(ByReqsFull(availableProviders))
+	e, ok := g.cache.Get(key)
+	if !ok {
+		// expired or evicted from the cache
+		g.spatial.Remove(key)
+		return
+	}
+	res = Result{Address: e.Address, Provider: e.Provider, FromCache: true, Distance: dist}
+	return
+}
 
-	dbg.D(TAG, "Sorted providers : ")
-	for _, v := range availableProviders {
-		dbg.D(TAG, "Provider : %+v", *v)
+// geocodeWithProviders walks through the available providers until one of them returns a complete address.
+// access are the providers the user may use - the plan of the user has already been checked by the caller.
+func (g *Geocoder) geocodeWithProviders(ctx context.Context, q *Query, dontChain bool, isReverse bool, access userAccess) (res Result, err error) {
+	success := false
+	availableProviders := g.sortedProviders(dontChain, access)
+	if Debug {
+		g.log.D(TAG, "Sorted providers : ")
+		for _, v := range availableProviders {
+			g.log.D(TAG, "Provider : %s", v.name)
+		}
 	}
 	var tempRes models.Address
+	var isChain, noCache bool
 	for _, v := range availableProviders {
-		if v.UsersToReqCount == nil {
-			v.UsersToReqCount = make(map[string]int)
-		}
-		tempRes, err = GeocodeForProvider(s, v, uId, false)
-		if v.CurIntervalRequests == 1 {
-			v.FirstIntervalRequest = time.Now().UnixNano()
+		if ctx.Err() != nil {
+			// our caller gave up - don't spend the contingent of further providers
+			break
 		}
+		var latency time.Duration
+		tempRes, isChain, noCache, latency, err = g.geocodeForProvider(ctx, v, q, isReverse)
+		g.recordProviderResult(ctx, v, err, latency)
 		if err != nil {
 			if err == ErrNeedFixBeforeRetry {
-				dbg.E(TAG, "Error needing fix for geocode provider %s %s (type %d): ", v.Uri, v.Name, v.Type, err)
-				v.NextAllowedRequestTime = time.Now().UnixNano() + 60*60*1000*1000*1000
-
+				g.log.E(TAG, "Error needing fix for geocode provider %s : ", v.name, err)
 			} else if err == ErrSkipProvider {
 				err = nil
 				continue
+			} else if ctx.Err() != nil {
+				// only our caller giving up ends the walk - a provider timing out is an error like any other
+				g.log.I(TAG, "Lookup cancelled while asking geocode provider %s : ", v.name, err)
+				break
+			} else if err == ErrRateLimited {
+				g.log.W(TAG, "Geocode provider %s is rate limited", v.name)
 			} else if err == ErrEmptyResult {
-				dbg.W(TAG,"Geocoder returned 0 results")
-				if v.Type ==2 { // our chain providers already tried all geocoding providers - no sense in trying another
-					break;
+				g.log.W(TAG, "Geocoder returned 0 results")
+				if isChain { // our chain providers already tried all geocoding providers - no sense in trying another
+					break
 				}
-				continue;
-			}  else {
-				dbg.E(TAG, "Error for geocode provider %s %s (type %d): ", v.Uri, v.Name, v.Type, err)
-				v.NextAllowedRequestTime = time.Now().UnixNano() + 60*1000*1000*1000
+				continue
+			} else {
+				g.log.E(TAG, "Error for geocode provider %s : ", v.name, err)
 			}
 			continue
 		}
 
-		usedProvider = v
-		dbg.I(TAG, "Provider %s %s (type %d) has used %d of %d requests", v.Uri, v.Name, v.Type, v.CurIntervalRequests, v.MaxRequestsPerInterval)
+		res.Provider = v.name
 		success = true
 		if tempRes.HouseNumber == "" || tempRes.Street == "" || tempRes.City == "" {
-			if res.City == "" && tempRes.City !=""{
-				res = tempRes
-			}else if res.Street == "" && tempRes.Street !=""{
-				res = tempRes
+			if res.Address.City == "" && tempRes.City != "" {
+				res.Address, res.NoCache = tempRes, noCache
+			} else if res.Address.Street == "" && tempRes.Street != "" {
+				res.Address, res.NoCache = tempRes, noCache
 			}
-			if v.Type !=2 { //2=chain provider = last where we could get a better result
+			if !isChain { // chain provider = last where we could get a better result
 				// see if we can find anything better with another provider
 				continue
 			}
 		} else {
-			res = tempRes
+			res.Address, res.NoCache = tempRes, noCache
 		}
 
 		break
 
 	}
 	if !success {
-		if err != ErrEmptyResult {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if err != ErrEmptyResult {
 			err = ErrNoRequestsLeft
 		}
 	} else {
 		err = nil
 	}
-	RecalcRequestCounts(dontChain)
+	res.sent = q.sent
+	g.recalcRequestCounts(dontChain)
 
 	return
 }
 
-func RecalcRequestCounts(dontChain bool) {
-	var maxRequestsPerDay int
-	var maxRequestsPerUser int
-	var curDailyRequestsUsed int
-	var curRequestsByUserUsed = make(map[string]int)
-	var availableProviders []*models.GeoCodeProvider
-	if dontChain {
-		availableProviders = NonChainProviders
-	} else {
-		availableProviders = ChainProviders
+// recordProviderResult counts the outcome of a request to the provider for the status, updates its circuit breaker &
+// tells the observer. Failures open the breaker after BreakerThreshold errors in a row, ErrNeedFixBeforeRetry right away.
+// Errors after ctx is done are not held against the provider, as our caller gave up.
+func (g *Geocoder) recordProviderResult(ctx context.Context, p *providerState, err error, latency time.Duration) {
+	g.observer.ProviderRequest(p.name, outcomeOf(err), latency)
+	now := g.now()
+	p.Lock()
+	defer p.Unlock()
+	if latency > 0 {
+		p.stats.lastLatency = latency
+	}
+	switch {
+	case err == nil:
+		p.stats.successes++
+		p.breaker.success()
+	case err == ErrEmptyResult:
+		p.stats.empty++
+		p.breaker.success()
+	case err == ErrSkipProvider:
+		p.stats.skips++
+	case err == ErrRateLimited:
+		// the provider works, it just wants us to wait - NextAllowedRequestTime already keeps us away
+		p.stats.errors++
+		p.stats.lastError = err.Error()
+		p.stats.lastErrorTime = now
+		p.breaker.trialInFlight = false
+	case ctx.Err() != nil:
+		// our caller gave up - that says nothing about the provider
+		p.breaker.trialInFlight = false
+	default:
+		p.stats.errors++
+		p.stats.lastError = err.Error()
+		p.stats.lastErrorTime = now
+		if err == ErrNeedFixBeforeRetry {
+			p.breaker.open(now, needFixBackoff)
+		} else {
+			p.breaker.failure(p.prov, now)
+		}
+		if p.breaker.State(now) == BreakerOpen {
+			g.log.W(TAG, "Circuit of provider %s opened until %v", p.name, p.breaker.openUntil)
+		}
 	}
-	for _, v := range availableProviders {
-		maxRequestsPerDay += v.MaxRequestsPerInterval / v.IntervalSizeInDays
-		maxRequestsPerUser += v.MaxRequestsPerUserAndDay
-		curDailyRequestsUsed += v.CurIntervalRequests
+}
+
+func (g *Geocoder) recalcRequestCounts(dontChain bool) {
+	var counts []providerCount
+	g.providersMu.RLock()
+	for _, p := range g.providerList(dontChain) {
+		p.Lock()
+		v := p.prov
+		resetUserCountsDaily(v, g.now().UnixNano())
+		c := providerCount{
+			name:            p.name,
+			curDailyUsed:    v.CurIntervalRequests,
+			maxPerUser:      v.MaxRequestsPerUserAndDay,
+			usersToReqCount: make(map[string]int, len(v.UsersToReqCount)),
+			access: models.GeoCodeProvider{
+				AllowedUsers: v.AllowedUsers,
+				AllowedPlans: v.AllowedPlans,
+				DeniedUsers:  v.DeniedUsers,
+				DeniedPlans:  v.DeniedPlans,
+			},
+		}
+		if days := intervalDays(v); days != 0 {
+			c.maxPerDay = v.MaxRequestsPerInterval / days
+		}
 		for uId, cnt := range v.UsersToReqCount {
-			curRequestsByUserUsed[uId] += cnt
+			c.usersToReqCount[uId] = cnt
 		}
+		counts = append(counts, c)
+		p.Unlock()
 	}
+	g.providersMu.RUnlock()
 
-	MaxRequestsPerDay = maxRequestsPerDay
-	MaxRequestsPerUser = maxRequestsPerUser
-	CurDailyRequestsUsed = curDailyRequestsUsed
-	CurRequestsByUserUsed = curRequestsByUserUsed
-	dbg.I(TAG, " Recalced MaxRequestsPerDay %d\r\n MaxRequestsPerUser %d\r\n CurDailyRequestsUsed %d\r\n CurRequestsByUserUsed %+v",
-		MaxRequestsPerDay, MaxRequestsPerUser, CurDailyRequestsUsed, CurRequestsByUserUsed)
+	g.statsMu.Lock()
+	g.providerCounts = counts
+	g.statsMu.Unlock()
+	g.log.I(TAG, " Recalced request counts of %d providers", len(counts))
 }
 
-func CheckIfProviderAvailable(provider *models.GeoCodeProvider,uId string) (err error) {
-	dbg.I(TAG, "Current provider : %+v", *provider)
-	if provider.CurIntervalRequests == 0 || provider.FirstIntervalRequest + 24*60*60*1000*1000*1000*int64(provider.IntervalSizeInDays) < time.Now().UnixNano() {
+// checkIfProviderAvailable returns ErrSkipProvider if the provider should not be used right now. If the next allowed
+// request time is less than a second away, wait is set to the time the caller needs to sleep before sending the request.
+// The caller needs to hold the lock of the provider.
+func (g *Geocoder) checkIfProviderAvailable(provider *models.GeoCodeProvider, uId string) (wait time.Duration, err error) {
+	g.log.I(TAG, "Current provider : %s", provider.Name)
+	now := g.now().UnixNano()
+	if provider.CurIntervalRequests == 0 || intervalEnd(provider) < now {
 		provider.UsersToReqCount = make(map[string]int)
 		provider.CurIntervalRequests = 0
 	}
-	if !CheckIfProviderHasRequestsLeft(provider) {
+	resetUserCountsDaily(provider, now)
+	if !CheckIfProviderHasRequestsLeft(provider, now) {
 		// we used up our daily contingent
-		provider.NextAllowedRequestTime = provider.FirstIntervalRequest + 24*60*60*1000*1000*1000*int64(provider.IntervalSizeInDays)
-		if provider.NextAllowedRequestTime > time.Now().UnixNano() {
-			dbg.I(TAG, "Geocoding contingent for provider %s %s (type %d) used up - skipping this provider", provider.Uri, provider.Name, provider.Type)
+		provider.NextAllowedRequestTime = intervalEnd(provider)
+		if provider.NextAllowedRequestTime > now {
+			g.log.I(TAG, "Geocoding contingent for provider %s %s (type %s) used up - skipping this provider", provider.Uri, provider.Name, ProviderTypeName(provider))
 			err = ErrSkipProvider
 			return
 		}
 	}
 	if provider.UsersToReqCount[uId] >= provider.MaxRequestsPerUserAndDay && provider.MaxRequestsPerUserAndDay != 0 {
-		dbg.I(TAG, "Geocoding contingent for this user & provider %s %s (type %d) used up - skipping this provider", provider.Uri, provider.Name, provider.Type)
+		g.log.I(TAG, "Geocoding contingent for this user & provider %s %s (type %s) used up - skipping this provider", provider.Uri, provider.Name, ProviderTypeName(provider))
 		err = ErrSkipProvider
 		return
 	}
-	if provider.NextAllowedRequestTime > time.Now().UnixNano() {
-		dbg.I(TAG, "We are before next allowed request time for this geocoder")
-		diff := provider.NextAllowedRequestTime - time.Now().UnixNano()
+	if provider.NextAllowedRequestTime > now {
+		g.log.I(TAG, "We are before next allowed request time for this geocoder")
+		diff := provider.NextAllowedRequestTime - now
 		if diff < 1*1000*1000*1000 {
-			dbg.I(TAG, "Waiting, because next allowed time is less than 1 second from now")
-			time.Sleep(time.Duration(diff) * time.Nanosecond)
+			g.log.I(TAG, "Waiting, because next allowed time is less than 1 second from now")
+			wait = time.Duration(diff) * time.Nanosecond
 		} else {
-			dbg.I(TAG, "Skip this provider")
+			g.log.I(TAG, "Skip this provider")
 			err = ErrSkipProvider
 			return
 		}
@@ -299,594 +489,180 @@ func CheckIfProviderAvailable(provider *models.GeoCodeProvider,uId string) (err
 	return
 }
 
-func ReverseGeocodeForProvider(lat float64, lng float64, provider *models.GeoCodeProvider, userId string, dontChain bool) (res models.Address, err error) {
-	err = CheckIfProviderAvailable(provider,userId)
-	ChangesSinceLastSave = true
+// geocodeForProvider sends a single reverse or forward request to the provider, using the registered Provider
+// implementation for its type. The lock is held while checking & reserving the request and while applying the response,
+// but not while waiting for the provider. isChain tells if the provider was a chained odl-geocoder, latency how long
+// the request took (0 if none was sent). noCache is set if the terms of the provider do not allow to store the result.
+func (g *Geocoder) geocodeForProvider(ctx context.Context, p *providerState, q *Query, isReverse bool) (res models.Address, isChain bool, noCache bool, latency time.Duration, err error) {
+	var impl Provider
+	var uri string
+	var wait time.Duration
+	var userAgent string
+	p.Lock()
+	provider := p.prov
+	impl, err = GetProviderImpl(provider)
 	if err != nil {
-		return
+		g.log.E(TAG, "No implementation for provider %s %s (type %s)", provider.Uri, provider.Name, ProviderTypeName(provider))
+	} else {
+		isChain = impl.IsChain()
+		wait, err = g.checkIfProviderAvailable(provider, q.UserId)
 	}
-	uri := provider.Uri
-	switch provider.Type {
-	case 1: // geocode.farm
-		{
-			uri = uri + fmt.Sprintf("/reverse/?lat=%f&lon=%f&lang=en", lat, lng)
-		}
-	case 2: // Chain
-		{
-			uri = uri + fmt.Sprintf("/reverse/%s/bla/blub/%f/%f?dontChain=1", userId, lat, lng)
-		}
-	case 3:  // Tomtom
-		{
-			uri = uri + fmt.Sprintf("/reverseGeocode/%f,%f.JSON?key=%s", lat,lng,provider.Key1)
+	if err == nil {
+		if isReverse {
+			uri, err = impl.ReverseUri(provider, q)
+		} else {
+			uri, err = impl.ForwardUri(provider, q)
 		}
-	case 4:  // OpenCage
-		{
-			uri = uri + fmt.Sprintf("&q=%f,%f&key=%s", lat,lng,provider.Key1)
+		if err != nil {
+			g.log.E(TAG, "Error building request uri : ", err)
 		}
 	}
-
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		dbg.E(TAG, "Error initializing httpRequest : ", err)
-		return
-	}
-	/* Get Details */
-	var resp *http.Response
-	provider.LastRequestTime = time.Now().UnixNano()
-	provider.NextAllowedRequestTime = provider.LastRequestTime + provider.TimeBetweenRequests
-	ChangesSinceLastSave = true
-	if Debug {
-		dbg.I(TAG, "Sending request with uri : %s", uri)
+	if err == nil && !p.breaker.allow(g.now()) {
+		g.log.I(TAG, "Circuit of provider %s is open - skipping this provider", p.name)
+		err = ErrSkipProvider
 	}
-	if provider.Type==3 { // TomTom does not report back current daily count
-		if provider.FirstIntervalRequest + 60*60*24*1000*1000*1000<time.Now().UnixNano() {
-			provider.CurIntervalRequests = 0
-			provider.UsersToReqCount = make(map[string]int)
-			provider.FirstIntervalRequest = time.Now().UnixNano()
+	if err == nil {
+		// reserve our slot, so concurrent requests respect TimeBetweenRequests as well
+		between := provider.TimeBetweenRequests
+		if s, ok := impl.(RequestSpacer); ok && int64(s.MinTimeBetweenRequests(provider)) > between {
+			between = int64(s.MinTimeBetweenRequests(provider))
 		}
-		provider.CurIntervalRequests++
+		provider.LastRequestTime = g.now().Add(wait).UnixNano()
+		provider.NextAllowedRequestTime = provider.LastRequestTime + between
+		userAgent = provider.UserAgent
 	}
-	resp, err = client.Do(req)
+	p.Unlock()
+	g.markChanged()
 	if err != nil {
-		dbg.E(TAG, "Error executing reverse geocode request: %s", err)
 		return
 	}
-	var _body []byte
-	_body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		if err != nil {
-			dbg.E(TAG, "Error reading reverse geocode response: %s", err)
-			FillUnknownAddress(&res)
-			return res, ErrNeedFixBeforeRetry
-		}
-	}
-	err = FillAddrAndNextTimeFromResp(_body,provider,&res, userId,true)
-	if provider.Type!=2 { // our chain provider returns the requests used for this user, for others we need to keep track ourselfs.
-		provider.UsersToReqCount[userId] = provider.UsersToReqCount[userId] + 1
-	}
-	ChangesSinceLastSave = true
-	return
-}
 
-var OpenCageRegExp *regexp.Regexp
-
-func GeocodeForProvider(s string, provider *models.GeoCodeProvider, userId string, dontChain bool) (res models.Address, err error) {
-	if OpenCageRegExp == nil {
-		// replace Walterstal 101 09599 Freiberg with Walterstal 101, 09599 Freiberg
-		OpenCageRegExp = regexp.MustCompile("([0-9][A-Z]?)\\ ([0-9]{4,5})\\ (\\w)")
-	}
-	err = CheckIfProviderAvailable(provider,userId)
-	ChangesSinceLastSave = true
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
+		g.log.E(TAG, "Error initializing httpRequest : ", err)
 		return
 	}
-	uri := provider.Uri
-	switch provider.Type {
-	case 1: // geocode.farm
-		{
-			uri = uri + fmt.Sprintf("/forward/?addr=%s&lang=en=1",url.QueryEscape(s))
-		}
-	case 2: // Chain
-		{
-			uri = uri + fmt.Sprintf("/forward/%s/b/b/%s?dontChain=1", userId, url.QueryEscape(s))
-		}
-	case 3:  // Tomtom
-		{
-
-			uri = uri + fmt.Sprintf("/geocode/%s.JSON?key=%s", url.QueryEscape(s),provider.Key1)
-		}
-	case 4:  // OpenCage
-		{
-			// replace Walterstal 101 09599 Freiberg with Walterstal 101, 09599 Freiberg
-			s = OpenCageRegExp.ReplaceAllString(s,"$1, $2 $3")
-			uri = uri + fmt.Sprintf("&q=%s&key=%s", url.QueryEscape(s),provider.Key1)
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
 		}
 	}
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		dbg.E(TAG, "Error initializing httpRequest : ", err)
-		return
-	}
 	/* Get Details */
 	var resp *http.Response
-	provider.LastRequestTime = time.Now().UnixNano()
-	provider.NextAllowedRequestTime = provider.LastRequestTime + provider.TimeBetweenRequests
-	ChangesSinceLastSave = true
 	if Debug {
-		dbg.I(TAG, "Sending request with uri : %s", uri)
+		g.log.I(TAG, "Sending request with uri : %s", uri)
 	}
-	resp, err = client.Do(req)
+	g.countSentRequest(p, impl, isChain, q)
+	start := time.Now()
+	resp, err = g.client.Do(req)
 	if err != nil {
-		dbg.E(TAG, "Error executing forward geocode request: %s", err)
+		latency = time.Since(start)
+		g.log.E(TAG, "Error executing geocode request: %s", err)
 		return
 	}
+	defer resp.Body.Close()
 	var _body []byte
 	_body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		if err != nil {
-			dbg.E(TAG, "Error reading forward geocode response: %s", err)
-			FillUnknownAddress(&res)
-			return res, ErrNeedFixBeforeRetry
-		}
-	}
-	err = FillAddrAndNextTimeFromResp(_body,provider,&res, userId,false)
-	if provider.Type!=2 {
-		// our chain provider returns the requests used for this user, for others we need to keep track ourselfs.
-		provider.UsersToReqCount[userId] = provider.UsersToReqCount[userId] + 1
-	}
-	ChangesSinceLastSave = true
-	return
-}
+	latency = time.Since(start)
 
-func FillAddrAndNextTimeFromResp(_body []byte,provider *models.GeoCodeProvider,res *models.Address,uId string, isReverse bool) (err error){
-	switch provider.Type {
-	case 1: // GeoFarm
-		{
-			err = FillAddrFromGeoFarmResp(_body, provider, res)
-		}
-	case 2: // Chain
-		{
-			err = FillAddrFromChainResp(_body, provider, res, uId)
-		}
-	case 3: // TomTom
-		{
-			if isReverse {
-				err = FillAddrFromTomTomReverseResp(_body, provider, res)
-
-			} else {
-				err = FillAddrFromTomTomForwardResp(_body, provider, res)
-			}
-		}
-	case 4: // OpenCage
-		{
-			err = FillAddrFromOpenCageResp(_body, provider, res)
-		}
-	default:
-		err = ErrProviderNotSupported
-	}
-
-	if provider.MaxRequestsPerInterval-provider.CurIntervalRequests < 0 { // usage limit exceeded - wait 10 minutes before next request
-		provider.NextAllowedRequestTime = time.Now().UnixNano() + 10*60*1000*1000*1000
-	}
+	p.Lock()
+	defer p.Unlock()
+	defer g.markChanged()
 	if err != nil {
-		dbg.W(TAG, "Error filling address : ", err)
-	}
-	return
-}
-func FillUnknownAddress(add *models.Address) {
-	add.Street = "Unbekannt"
-	add.Postal = ""
-	add.City = "Unbekannt"
-	add.HouseNumber = ""
-	return
-}
-func FillAddrFromGeoFarmResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address) (err error) {
-	if addr == nil {
-		dbg.E(TAG, "Error : Got nil address to fil")
-		return errors.New("Address object is nil.")
+		g.log.E(TAG, "Error reading geocode response: %s", err)
+		FillUnknownAddress(&res)
+		return res, isChain, false, latency, ErrNeedFixBeforeRetry
 	}
-
-	var r models.GeoCodeFarmResult
-	res := models.GeoCodeFarmResp{}
-	err = json.Unmarshal(resp, &res)
+	q.Time = g.now()
+	err = g.checkResponse(resp, _body, provider, q.Time)
 	if err != nil {
-		dbg.E(TAG, "Error processing GeoCodeFarmResponse : ", err)
-		if Debug {
-			dbg.I(TAG, "Response : ", string(resp))
-		}
-	}
-	if Debug {
-		dbg.I(TAG, "Parsed result : %+v \r\n from resp %s", res.GeocodingResults, string(resp))
-	}
-	if len(res.GeocodingResults.Results) > 0 {
-		if len(res.GeocodingResults.Results) == 1 {
-			r = res.GeocodingResults.Results[0]
-		} else {
-			for _,v := range res.GeocodingResults.Results {
-				if r.FormattedAddress =="" {
-					r = v
-				} else if r.Address.Locality=="" && v.Address.Locality!="" {
-					r = v
-				} else if r.Address.Postal=="" && v.Address.Postal!="" && v.Address.Locality!=""{
-					r = v
-				} else if r.Address.StreetName=="" && v.Address.StreetName!="" && v.Address.Postal!="" && v.Address.Locality!=""{
-					r = v
-				} else if r.Address.StreetNumber=="" && v.Address.StreetNumber!="" && v.Address.StreetName!="" && v.Address.Postal!="" && v.Address.Locality!=""{
-					r = v
-				}
-				if r.Address.StreetNumber != "" {
-					break;
-				}
-			}
-		}
-	}
-	acc := res.GeocodingResults.Account
-
-	if acc.UsageLimit != "" {
-		var ul int64
-		var us int64
-		ul, err = strconv.ParseInt(acc.UsageLimit, 10, 64)
-		if err != nil {
-			dbg.W(TAG, "Could not parse usage limit : ", acc.UsageLimit, err)
-			err = nil
-		} else {
-			provider.MaxRequestsPerInterval = int(ul)
-			us, err = strconv.ParseInt(acc.UsedToday, 10, 64)
-			if err != nil {
-				dbg.W(TAG, "Could not parse used today : ", acc.UsedToday, err)
-				err = nil
-			} else {
-				provider.CurIntervalRequests = int(us)
-			}
-		}
-	} else {
-		dbg.W(TAG, "No Account in GeoCodeFarmResponse?")
-	}
-
-	if r.FormattedAddress != "" {
-
-		a := r.Address
-		addr.HouseNumber = a.StreetNumber
-		addr.City = a.Locality
-		addr.Street = a.StreetName
-		addr.Postal = a.Postal
-		addr.Lat, _ = strconv.ParseFloat(r.Coordinates.Latitude, 64)
-		addr.Lng, _ = strconv.ParseFloat(r.Coordinates.Longitude, 64)
-		addr.Country = a.Country
-		addr.Title = r.FormattedAddress
-		if Debug {
-			dbg.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, a)
-		}
+		FillUnknownAddress(&res)
 		return
-	} else {
-		FillUnknownAddress(addr)
-		return ErrEmptyResult
-	}
-
-}
-
-func FillAddrFromTomTomForwardResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address) (err error) {
-	if addr == nil {
-		dbg.E(TAG, "Error : Got nil address to fil")
-		return errors.New("Address object is nil.")
 	}
-
-	var r models.TomTomForwardResult
-	res := models.TomTomForwardResp{}
-	err = json.Unmarshal(resp, &res)
-	if err != nil {
-		dbg.E(TAG, "Error processing TomTomForwardResponse : ", err)
-		if Debug {
-			dbg.I(TAG, "Response : ", string(resp))
-		}
+	err = g.fillAddrAndNextTimeFromResp(_body, provider, &res, q, isReverse)
+	if c, ok := impl.(CachePolicy); ok {
+		noCache = !c.Cacheable(_body, provider)
 	}
-	if Debug {
-		dbg.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	if provider.CurIntervalRequests == 1 {
+		provider.FirstIntervalRequest = q.Time.UnixNano()
 	}
-	if len(res.Results) > 0 {
-		if len(res.Results) == 1 {
-			r = res.Results[0]
-		} else {
-			for _,v := range res.Results {
-				if CompareTomTomAddress(&v.Address,&r.Address) {
-					r = v
-				}
-				if r.Address.StreetNumber != "" || r.Address.BuildingNumber!="" {
-					break;
-				}
-			}
-		}
-	}
-
-	if r.Address.FreeFormAddress != "" {
-		FillAddrFromTomTomAddress(&r.Address,addr)
-		addr.Lat = r.Position.Lat
-		addr.Lng = r.Position.Lon
-
-		if Debug {
-			dbg.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Address)
-		}
-		return
-	} else {
-		FillUnknownAddress(addr)
-		return ErrEmptyResult
-	}
-
+	g.log.I(TAG, "Provider %s %s (type %s) has used %d of %d requests", provider.Uri, provider.Name, ProviderTypeName(provider), provider.CurIntervalRequests, provider.MaxRequestsPerInterval)
+	return
 }
 
-func FillAddrFromTomTomReverseResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address) (err error) {
-	if addr == nil {
-		dbg.E(TAG, "Error : Got nil address to fil")
-		return errors.New("Address object is nil.")
+// countSentRequest counts a request we are about to send for the user & for providers that do not report back their
+// usage (RequestCounter), so failed requests that still use up the contingent are counted as well.
+func (g *Geocoder) countSentRequest(p *providerState, impl Provider, isChain bool, q *Query) {
+	p.Lock()
+	defer p.Unlock()
+	defer g.markChanged()
+	provider := p.prov
+	q.Time = g.now()
+	q.sent = true
+	if c, ok := impl.(RequestCounter); ok {
+		c.CountRequest(provider, q)
+	}
+	resetUserCountsDaily(provider, q.Time.UnixNano())
+	if !isChain { // our chain provider returns the requests used for this user, for others we need to keep track ourselfs.
+		provider.UsersToReqCount[q.UserId] = provider.UsersToReqCount[q.UserId] + 1
 	}
+}
 
-	var res models.TomTomReverseResp
-	var r models.TomTomReverseResult
-	err = json.Unmarshal(resp, &res)
-	if err != nil {
-		dbg.E(TAG, "Error processing TomTomReverseResponse : ", err)
-		if Debug {
-			dbg.I(TAG, "Response : ", string(resp))
-		}
-	}
-	if Debug {
-		dbg.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
-	}
-	if len(res.Addresses) > 0 {
-		if len(res.Addresses) == 1 {
-			r = res.Addresses[0]
+// fillAddrAndNextTimeFromResp updates the quota of the provider & fills res from the given response body.
+// The caller needs to hold the lock of the provider.
+func (g *Geocoder) fillAddrAndNextTimeFromResp(_body []byte, provider *models.GeoCodeProvider, res *models.Address, q *Query, isReverse bool) (err error) {
+	impl, err := GetProviderImpl(provider)
+	if err == nil {
+		impl.UpdateQuota(_body, provider, q, g.log)
+		if isReverse {
+			err = impl.ParseReverse(_body, provider, res, g.log)
 		} else {
-			for _,v := range res.Addresses {
-				if CompareTomTomAddress(&v.Address,&r.Address) {
-					r = v
-				}
-				if r.Address.StreetNumber != "" || r.Address.BuildingNumber!="" {
-					break;
-				}
-			}
+			err = impl.ParseForward(_body, provider, res, g.log)
 		}
 	}
 
-	if r.Address.FreeFormAddress != "" {
-		FillAddrFromTomTomAddress(&r.Address,addr)
-		splitted := strings.Split(r.Position,",")
-		if len(splitted)==2 {
-			addr.Lat, _ = strconv.ParseFloat(splitted[0],64)
-			addr.Lng, _ = strconv.ParseFloat(splitted[1],64)
-		}
-
-		if Debug {
-			dbg.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Address)
-		}
-		return
-	} else {
-		FillUnknownAddress(addr)
-		return ErrEmptyResult
-	}
-
-}
-
-func FillAddrFromTomTomAddress (a *models.TomTomAddress,b *models.Address) {
-	if a.StreetNumber != "" {
-		b.HouseNumber = a.StreetNumber
-	} else {
-		b.HouseNumber = a.BuildingNumber
+	if provider.MaxRequestsPerInterval != 0 && provider.MaxRequestsPerInterval-provider.CurIntervalRequests < 0 { // usage limit exceeded - wait 10 minutes before next request
+		provider.NextAllowedRequestTime = q.Time.UnixNano() + 10*60*1000*1000*1000
 	}
-	b.City = a.Municipality
-	if a.Street!="" {
-		b.Street = a.Street
-	} else {
-		b.Street = a.StreetName
-	}
-	// Chemnitzer Straße, Dampfbahn-Route Sachsen
-	commaIdx := strings.Index(string(b.Street), ",")
-	if commaIdx > 0 {
-		b.Street = string(b.Street)[0:commaIdx]
-	}
-	b.Postal = a.PostalCode
-	b.Country = a.CountryCode
-	b.Title = a.FreeFormAddress
-}
-
-func FillAddrFromOpenCageAddress (r *models.OpenCageResult,b *models.Address) {
-	a := r.Components
-	b.HouseNumber = a.HouseNumber
-	if a.City!="" {
-		b.City = a.City
-	} else {
-		b.City = a.Town
-	}
-	if a.Road == "" {
-		b.Street = a.Footway
-	} else {
-		b.Street = a.Road
-	}
-	// Chemnitzer Straße, Dampfbahn-Route Sachsen
-	commaIdx := strings.Index(string(b.Street), ",")
-	if commaIdx > 0 {
-		b.Street = string(b.Street)[0:commaIdx]
-	}
-	b.Postal = a.PostCode
-	b.Country = a.Country
-	b.Title = r.Formatted
-	b.Lat = r.Geometry.Lat
-	b.Lng = r.Geometry.Lng
-	b.Accuracy = fmt.Sprintf("%d",r.Confidence)
-	b.Fuel = a.Fuel
-}
-// returns true if a is better then b
-func CompareTomTomAddress(a *models.TomTomAddress, b *models.TomTomAddress) (bool) {
-	if a.FreeFormAddress =="" && b.FreeFormAddress!=""{
-		return false
-	} else if a.Municipality=="" && b.Municipality!="" {
-		return false
-	} else if a.PostalCode=="" && b.PostalCode!="" && b.Municipality!=""{
-		return false
-	} else if a.StreetName=="" && a.Street=="" &&
-	(b.StreetName!="" || b.Street!="") &&
-	b.PostalCode!="" && b.Municipality!=""{
-		return false
-	} else if a.StreetNumber=="" && a.BuildingNumber=="" && (b.StreetNumber!="" || b.BuildingNumber!="" )&&
-	(b.StreetName!="" || b.Street!="") &&
-	b.PostalCode!="" && b.Municipality!="" {
-		return false
-	}
-	return true
-}
-func FillAddrFromChainResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, uId string) (err error) {
-	if addr == nil {
-		dbg.E(TAG, "Error : Got nil address to fil")
-		return errors.New("Address object is nil.")
-	}
-
-	var r models.GeoResp
-	err = json.Unmarshal(resp, &r)
 	if err != nil {
-		dbg.E(TAG, "Error processing Chain Resp : ", err)
-		if Debug {
-			dbg.I(TAG, "Response : ", string(resp))
-		}
+		g.log.W(TAG, "Error filling address : ", err)
 	}
-	*addr = r.Address
-	provider.MaxRequestsPerUserAndDay = r.MaxRequestsPerUser
-	provider.MaxRequestsPerInterval = r.MaxRequestsPerDay
-	provider.CurIntervalRequests = r.CurDailyRequestsUsed
-	provider.UsersToReqCount[uId] = r.CurUserRequestsUsed
 	return
 }
 
-func FillAddrFromOpenCageResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address) (err error) {
-	if addr == nil {
-		dbg.E(TAG, "Error : Got nil address to fil")
-		return errors.New("Address object is nil.")
-	}
-
-	var r models.OpenCageResult
-	res := models.OpenCageResponse{}
-	err = json.Unmarshal(resp, &res)
-	if err != nil {
-		dbg.E(TAG, "Error processing OpenCageResponse : ", err)
-		if Debug {
-			dbg.I(TAG, "Response : ", string(resp))
-		}
-	}
-	if Debug {
-		dbg.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
-	}
-	provider.FirstIntervalRequest = int64(res.Rate.Reset)*1000*1000*1000-60*60*24*1000*1000*1000 // 24 hours before interval reset = first request
-	provider.CurIntervalRequests = res.Rate.Limit-res.Rate.Remaining
-	provider.MaxRequestsPerInterval = res.Rate.Limit
-	if len(res.Results) > 0 {
-		if len(res.Results) == 1 {
-			r = res.Results[0]
-		} else {
-			for _,v := range res.Results {
-				if r.Formatted =="" && v.Formatted!=""{
-					r = v
-				} else if r.Components.Town=="" && r.Components.City == "" && (v.Components.Town!="" || v.Components.City!="") {
-					r = v
-				} else if r.Components.PostCode=="" && v.Components.PostCode!="" && (v.Components.Town!="" || v.Components.City!="") {
-					r = v
-				} else if r.Components.Road=="" && r.Components.Footway=="" && (v.Components.Road!="" || v.Components.Footway!="") &&
-				v.Components.PostCode!="" && (v.Components.Town!="" || v.Components.City!=""){
-					r = v
-				} else if r.Components.HouseNumber=="" && v.Components.HouseNumber!="" &&
-				(v.Components.Road!="" || v.Components.Footway!="") &&
-				v.Components.PostCode!="" && (v.Components.Town!="" || v.Components.City!="") {
-					r = v
-				} else if r.Components.Fuel=="" && v.Components.Fuel!="" &&
-				v.Components.HouseNumber!="" && (v.Components.Road!="" || v.Components.Footway!="") &&
-				v.Components.PostCode!="" && (v.Components.Town!="" || v.Components.City!="") {
-					r = v
-				}
-				if r.Components.HouseNumber != "" && r.Components.Fuel != "" && (r.Components.Road!="" || r.Components.Footway!="") {
-					break;
-				}
-			}
-		}
-	}
-
-	if r.Formatted != "" {
-		FillAddrFromOpenCageAddress(&r,addr)
-		if Debug {
-			dbg.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Components)
-		}
-		return
-	} else {
-		FillUnknownAddress(addr)
-		return ErrEmptyResult
-	}
-
+func FillUnknownAddress(add *models.Address) {
+	add.Street = "Unbekannt"
+	add.Postal = ""
+	add.City = "Unbekannt"
+	add.HouseNumber = ""
+	return
 }
-func ParseProviders(jsonb []byte) (err error) {
-	if len(AllProviders) != 0 {
-		SaveProviders(true)
-	}
-	servers := []*models.GeoCodeProvider{}
-	err = json.Unmarshal(jsonb, &servers)
-	if err != nil {
-		dbg.E(TAG, "Error parsing chained servers :( ", err)
-		return
-	}
-	ChainProviders = make ([]*models.GeoCodeProvider,0)
-	NonChainProviders = make ([]*models.GeoCodeProvider,0)
-	AllProviders = make ([]*models.GeoCodeProvider,0)
-	savedProviders := make([]*models.GeoCodeProvider,0)
-	provNameToSave := make(map[string]*models.GeoCodeProvider)
-	if _, _err := os.Stat("AutoSavedProviders.json"); _err == nil {
 
-		var b []byte
-		b, err = ioutil.ReadFile("AutoSavedProviders.json")
-		if err != nil {
-			dbg.E(TAG, "Error reading previous provider data : ")
-			return
-		}
-		err = json.Unmarshal(b, &savedProviders)
-		if err != nil {
-			dbg.E(TAG, "Error parsing previous provider data : ")
-			return
-		}
-
-		for _, v := range savedProviders {
-			if provNameToSave[v.Name] != nil {
-				dbg.E(TAG, "Multiple providers with same name not allowed! Please correct this in Providers.json AND AutoSavedProviders.json ")
-				return errors.New("Multiple providers with same name not allowed! Please correct this in Providers.json AND AutoSavedProviders.json")
-			}
-			provNameToSave[v.Name] = v
+// copyProvider returns a copy of the provider that can be used without holding its lock.
+func (p *providerState) copyProvider() (c models.GeoCodeProvider) {
+	p.Lock()
+	defer p.Unlock()
+	c = *p.prov
+	if p.prov.UsersToReqCount != nil {
+		c.UsersToReqCount = make(map[string]int, len(p.prov.UsersToReqCount))
+		for k, v := range p.prov.UsersToReqCount {
+			c.UsersToReqCount[k] = v
 		}
 	}
-	for _, v := range servers {
-		if provNameToSave[v.Name] != nil {
-			p := provNameToSave[v.Name]
-			v.CurIntervalRequests = p.CurIntervalRequests
-			v.FirstIntervalRequest = p.FirstIntervalRequest
-			v.LastRequestTime = p.LastRequestTime
-			v.NextAllowedRequestTime = p.NextAllowedRequestTime
-			v.UsersToReqCount = p.UsersToReqCount
-			dbg.WTF(TAG,"Updated provider from AutoSavedProviders.json - Result : %+v",v)
-		}
-		AllProviders = append(AllProviders, v)
-		if !v.Disabled {
-			NonChainProviders = append(NonChainProviders,v)
-			ChainProviders = append(ChainProviders, v)
-			if !v.ChainingForbidden { // Yes, this seems counter-intuitive - but if dontChain = false, we are the root-server
-				// and need to ask this provider - otherwise we don't.
-				NonChainProviders = append(NonChainProviders,v)
-			}
+	if p.prov.Options != nil {
+		c.Options = make(map[string]string, len(p.prov.Options))
+		for k, v := range p.prov.Options {
+			c.Options[k] = v
 		}
 	}
 	return
 }
-
-func SaveProviders(force bool) {
-	if ChangesSinceLastSave || force {
-		data, err := json.Marshal(AllProviders)
-		if err != nil {
-			dbg.E(TAG,"Unable to marshal providers : ", err)
-		}
-		err = ioutil.WriteFile("AutoSavedProviders.json",data,os.FileMode(0777))
-		if err != nil {
-			dbg.E(TAG,"Unable to autosave providers : ", err)
-		}
-	}
-}
\ No newline at end of file
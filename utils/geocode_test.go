@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWalkGeocoder returns a Geocoder asking a hanging tomtom provider first & a working one second. The hanging one
+// answers once the request is cancelled or after 2 seconds.
+func newWalkGeocoder(t *testing.T, opts Options) (g *Geocoder, hung *int32, asked *int32) {
+	hung, asked = new(int32), new(int32)
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hung, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	t.Cleanup(hang.Close)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(asked, 1)
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	t.Cleanup(ok.Close)
+	g, err := NewGeocoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"hang","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1,"Priority":2,"BreakerThreshold":1},
+		{"Name":"ok","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1,"Priority":1}]`, hang.URL, ok.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCancelStopsProviderWalk(t *testing.T) {
+	g, hung, asked := newWalkGeocoder(t, Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := g.Reverse(ctx, 50.9, 13.3, RequestOptions{UserId: "a"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lookup took %v after it was cancelled", d)
+	}
+	if h, a := atomic.LoadInt32(hung), atomic.LoadInt32(asked); h != 1 || a != 0 {
+		t.Errorf("providers asked %d & %d times, want only the first one", h, a)
+	}
+	// our caller giving up is no failure of the provider
+	if s := g.Status().Providers[0]; s.Name != "hang" || s.Errors != 0 || s.ConsecutiveFailures != 0 || s.BreakerState != BreakerClosed {
+		t.Errorf("status of the cancelled provider : %+v", s)
+	}
+}
+
+func TestProviderTimeoutContinuesWalk(t *testing.T) {
+	g, hung, asked := newWalkGeocoder(t, Options{Client: &http.Client{Timeout: 50 * time.Millisecond}})
+	res, err := g.Reverse(context.Background(), 50.9, 13.3, RequestOptions{UserId: "a"})
+	if err != nil || res.Provider != "ok" {
+		t.Errorf("lookup : %+v, %v", res, err)
+	}
+	if h, a := atomic.LoadInt32(hung), atomic.LoadInt32(asked); h != 1 || a != 1 {
+		t.Errorf("providers asked %d & %d times, want 1 & 1", h, a)
+	}
+	if s := g.Status().Providers[0]; s.Name != "hang" || s.Errors != 1 || s.BreakerState != BreakerOpen {
+		t.Errorf("status of the provider timing out : %+v", s)
+	}
+}
+
+func TestCancelStopsSpacingWait(t *testing.T) {
+	var asked int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asked, 1)
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	g, err := NewGeocoder(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"tomtom","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1,"TimeBetweenRequests":900000000}]`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.Reverse(context.Background(), 50.9, 13.3, RequestOptions{UserId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next request has to wait 900ms for the provider
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = g.Reverse(ctx, 50.8, 13.3, RequestOptions{UserId: "a"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("lookup took %v, want it to stop waiting once cancelled", d)
+	}
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Errorf("provider got %d requests, want 1", n)
+	}
+	if _, _, _, used := g.RequestCounts("a"); used != 1 {
+		t.Errorf("user used %d requests, want only the one sent", used)
+	}
+}
@@ -0,0 +1,470 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is used by the Geocoder for all its output - the methods match github.com/Compufreak345/dbg.
+type Logger interface {
+	D(tag string, msg string, args ...interface{})
+	I(tag string, msg string, args ...interface{})
+	W(tag string, msg string, args ...interface{})
+	E(tag string, msg string, args ...interface{})
+}
+
+// dbgLogger is the default Logger, writing to github.com/Compufreak345/dbg.
+type dbgLogger struct{}
+
+func (dbgLogger) D(tag string, msg string, args ...interface{}) { dbg.D(tag, msg, args...) }
+func (dbgLogger) I(tag string, msg string, args ...interface{}) { dbg.I(tag, msg, args...) }
+func (dbgLogger) W(tag string, msg string, args ...interface{}) { dbg.W(tag, msg, args...) }
+func (dbgLogger) E(tag string, msg string, args ...interface{}) { dbg.E(tag, msg, args...) }
+
+// Options configure a Geocoder. Everything except Providers is optional.
+type Options struct {
+	Providers     []*models.GeoCodeProvider // the providers to chain, usually parsed from Providers.json
+	StateFile     string                    // file the request counts are saved to and restored from, e.g. AutoSavedProviders.json - empty = not persisted
+	ProvidersFile string                    // file changes of AddProvider & co are saved to before they are used, e.g. Providers.json - empty = not saved
+	Client        *http.Client              // client used for requests to the providers, defaults to one with a 5 second timeout
+	Now           func() time.Time          // clock, defaults to time.Now
+	Logger        Logger                    // defaults to github.com/Compufreak345/dbg
+	Observer      Observer                  // notified about provider requests & cache lookups, e.g. for metrics - optional
+
+	CacheSize      int           // max number of addresses kept in the in-memory cache, 0 = no cache
+	CachePrecision float64       // metres coordinates are rounded to for reverse lookups in the cache, defaults to 10
+	CacheTTL       time.Duration // how long cached addresses are used, 0 = forever
+
+	CacheFile           string      // bolt database file resolved addresses are persisted to, e.g. AutoSavedCache.db - empty = not persisted
+	CacheFileMaxEntries int         // max number of addresses kept in CacheFile, 0 = no limit
+	Cache               ResultCache // custom cache to use instead of the ones configured by CacheSize and CacheFile
+
+	NearbyRadius float64 // metres - reverse lookups are answered with a cached address this close, 0 = exact cache cells only
+
+	PlanUsageFile string // file the requests per user & plan are saved to and restored from - empty = not persisted
+}
+
+// RequestOptions are passed with every single Reverse or Forward request.
+type RequestOptions struct {
+	UserId    string      // the user the request counts against
+	DontChain bool        // set if we are asked by another odl-geocoder - don't ask other chained geocoders
+	Country   string      // ISO 3166 country code forward lookups are restricted to, for providers that support it
+	Focus     *BatchPoint // forward lookups prefer results close to this point, for providers that support it
+}
+
+// Result of a Reverse or Forward request.
+type Result struct {
+	Address   models.Address
+	Provider  string  // name of the provider the address is from
+	FromCache bool    // the address was served from cache and did not count against any contingent
+	Distance  float64 // metres between the requested coordinates and the ones of the cached lookup that was used
+	NoCache   bool    // the terms of the provider do not allow to store the address, so it was not cached
+
+	sent bool // a request was sent to a provider for the lookup - see Query.sent
+}
+
+// Geocoder chains requests between the configured providers. Several independent Geocoders can be used in one process,
+// all methods are safe for concurrent use.
+type Geocoder struct {
+	client        *http.Client
+	now           func() time.Time
+	log           Logger
+	observer      Observer
+	stateFile     string
+	providersFile string
+
+	cache          ResultCache // nil if caching is disabled
+	diskCache      *DiskCache  // nil if not persisted
+	cachePrecision float64
+	spatial        *SpatialIndex // nil if only exact cache cells are used
+	nearbyRadius   float64
+
+	// inFlight coalesces identical lookups running at the same time
+	inFlight coalescer
+
+	// providersMu guards the provider lists - the providers themselves are guarded by their own lock.
+	providersMu       sync.RWMutex
+	chainProviders    []*providerState
+	nonChainProviders []*providerState
+	allProviders      []*providerState
+
+	// statsMu guards the request counts calculated by recalcRequestCounts.
+	statsMu        sync.RWMutex
+	providerCounts []providerCount
+
+	// plansMu guards the plans & their usage.
+	plansMu       sync.RWMutex
+	plans         planState
+	planUsageFile string
+
+	// adminMu serializes changes to the configuration of the providers.
+	adminMu sync.Mutex
+
+	// Did anything change since we last saved the request counts?
+	changesSinceLastSave int32
+	// saveMu makes sure only one goroutine writes the state file at a time.
+	saveMu sync.Mutex
+}
+
+// NewGeocoder creates a Geocoder for the given options. If opts.StateFile exists, the request counts are restored from it.
+func NewGeocoder(opts Options) (g *Geocoder, err error) {
+	g = &Geocoder{
+		client:        opts.Client,
+		now:           opts.Now,
+		log:           opts.Logger,
+		observer:      opts.Observer,
+		stateFile:     opts.StateFile,
+		providersFile: opts.ProvidersFile,
+		planUsageFile: opts.PlanUsageFile,
+	}
+	if g.client == nil {
+		g.client = &http.Client{
+			Timeout: time.Duration(5 * time.Second),
+		}
+	}
+	if g.now == nil {
+		g.now = time.Now
+	}
+	if g.log == nil {
+		g.log = dbgLogger{}
+	}
+	if g.observer == nil {
+		g.observer = noopObserver{}
+	}
+	g.cachePrecision = opts.CachePrecision
+	if g.cachePrecision == 0 {
+		g.cachePrecision = 10
+	}
+	if opts.Cache != nil {
+		g.cache = opts.Cache
+	} else {
+		if opts.CacheFile != "" {
+			g.diskCache, err = OpenDiskCache(opts.CacheFile, opts.CacheFileMaxEntries, opts.CacheTTL, g.now)
+			if err != nil {
+				g.log.E(TAG, "Error opening cache file %s : ", opts.CacheFile, err)
+				return
+			}
+			g.cache = g.diskCache
+		}
+		if opts.CacheSize > 0 {
+			mem := NewMemoryCache(opts.CacheSize, opts.CacheTTL, g.now)
+			if g.cache != nil {
+				g.cache = TieredCache{Fast: mem, Slow: g.cache}
+			} else {
+				g.cache = mem
+			}
+		}
+	}
+	if g.cache != nil && opts.NearbyRadius > 0 {
+		g.nearbyRadius = opts.NearbyRadius
+		maxPoints := opts.CacheSize
+		if g.diskCache != nil {
+			maxPoints = opts.CacheFileMaxEntries
+		}
+		g.spatial = NewSpatialIndex(opts.NearbyRadius, maxPoints)
+		if g.diskCache != nil {
+			err = g.diskCache.ForEach(func(key string, e CacheEntry) {
+				if strings.HasPrefix(key, "r|") && (e.Lat != 0 || e.Lng != 0) {
+					g.spatial.Insert(key, e.Lat, e.Lng)
+				}
+			})
+			if err != nil {
+				g.log.E(TAG, "Error reading cache file for nearby lookups : ", err)
+				return
+			}
+		}
+	}
+	if g.planUsageFile != "" {
+		err = g.loadPlanUsage(g.planUsageFile)
+		if err != nil {
+			g.log.E(TAG, "Error reading plan usage file %s : ", g.planUsageFile, err)
+			return
+		}
+	}
+	err = g.SetProviders(opts.Providers)
+	return
+}
+
+// Reverse returns the address for the given coordinates.
+func (g *Geocoder) Reverse(ctx context.Context, lat float64, lng float64, opts RequestOptions) (res Result, err error) {
+	return g.geocode(ctx, &Query{Lat: lat, Lng: lng, UserId: opts.UserId}, opts.DontChain, true)
+}
+
+// Forward returns the address (including coordinates) for the given address string.
+func (g *Geocoder) Forward(ctx context.Context, query string, opts RequestOptions) (res Result, err error) {
+	return g.geocode(ctx, &Query{Address: query, UserId: opts.UserId, Country: opts.Country, Focus: opts.Focus}, opts.DontChain, false)
+}
+
+// ForwardStructured returns the address (including coordinates) for an address given in parts. Providers with a
+// structured search use the parts, all others the joined address (see JoinAddress).
+func (g *Geocoder) ForwardStructured(ctx context.Context, a StructuredAddress, opts RequestOptions) (res Result, err error) {
+	q := &Query{Address: a.String(), Structured: &a, UserId: opts.UserId, Country: opts.Country, Focus: opts.Focus}
+	return g.geocode(ctx, q, opts.DontChain, false)
+}
+
+// RequestCounts returns the request counts calculated after the last request. They only cover the providers the user
+// may use - maxPerUser & curUserUsed are the daily limit & usage of the plan of the user, if that is lower.
+func (g *Geocoder) RequestCounts(uId string) (maxPerDay int, maxPerUser int, curDailyUsed int, curUserUsed int) {
+	access := g.accessOf(uId)
+	g.statsMu.RLock()
+	for i := range g.providerCounts {
+		c := &g.providerCounts[i]
+		if access.allows(c.name, &c.access) {
+			maxPerDay += c.maxPerDay
+			curDailyUsed += c.curDailyUsed
+			maxPerUser += c.maxPerUser
+			curUserUsed += c.usersToReqCount[uId]
+		}
+	}
+	g.statsMu.RUnlock()
+	if access.hasPlan && access.plan.MaxRequestsPerDay > 0 && (maxPerUser == 0 || access.plan.MaxRequestsPerDay < maxPerUser) {
+		maxPerUser = access.plan.MaxRequestsPerDay
+		curUserUsed = g.PlanUsage(uId).DayCount
+	}
+	return
+}
+
+// NextAvailable returns the earliest time a provider might accept requests of the user again after all of them returned
+// ErrNoRequestsLeft - when the interval of a provider that is out of requests rolls over, or when it may be asked again
+// after an error or its open circuit breaker. Only providers the user may use are considered. The zero time means no
+// provider will become available by itself.
+func (g *Geocoder) NextAvailable(uId string) (t time.Time) {
+	now := g.now().UnixNano()
+	next := int64(0)
+	access := g.accessOf(uId)
+	g.providersMu.RLock()
+	defer g.providersMu.RUnlock()
+	for _, p := range g.allProviders {
+		p.Lock()
+		prov := p.prov
+		if !prov.Disabled && access.allows(p.name, prov) {
+			avail := prov.NextAllowedRequestTime
+			rollover := intervalEnd(prov)
+			outOfRequests := prov.MaxRequestsPerInterval != 0 && prov.MaxRequestsPerInterval-prov.CurIntervalRequests <= 1
+			if outOfRequests && rollover > avail {
+				avail = rollover
+			}
+			// the requests per user are counted per UTC day, also for providers with a longer interval
+			today := time.Unix(0, now).UTC()
+			userLimitReached := prov.MaxRequestsPerUserAndDay != 0 && prov.UsersToReqCountDay == today.Format("2006-01-02") &&
+				prov.UsersToReqCount[uId] >= prov.MaxRequestsPerUserAndDay
+			if dayEnd := time.Date(today.Year(), today.Month(), today.Day()+1, 0, 0, 0, 0, time.UTC).UnixNano(); userLimitReached && dayEnd > avail {
+				avail = dayEnd
+			}
+			if open := p.breaker.openUntil.UnixNano(); p.breaker.State(g.now()) == BreakerOpen && open > avail {
+				avail = open
+			}
+			if next == 0 || avail < next {
+				next = avail
+			}
+		}
+		p.Unlock()
+	}
+	if next == 0 {
+		return
+	}
+	if next <= now {
+		// nothing we know of keeps the provider from working, so it probably failed - try again later
+		next = now + int64(time.Minute)
+	}
+	return time.Unix(0, next)
+}
+
+// CacheStats returns the counters of the result cache.
+func (g *Geocoder) CacheStats() CacheStats {
+	if g.cache == nil {
+		return CacheStats{}
+	}
+	return g.cache.Stats()
+}
+
+// CompactCache removes expired addresses from the cache file and gives the space of removed ones back to the file system.
+func (g *Geocoder) CompactCache() (err error) {
+	if g.diskCache == nil {
+		return
+	}
+	err = g.diskCache.Compact()
+	if err != nil {
+		g.log.E(TAG, "Error compacting cache : ", err)
+	}
+	return
+}
+
+// Close releases the files used by the geocoder - call Save(true) before to persist the request counts.
+func (g *Geocoder) Close() (err error) {
+	if g.diskCache != nil {
+		err = g.diskCache.Close()
+	}
+	return
+}
+
+func (g *Geocoder) markChanged() {
+	atomic.StoreInt32(&g.changesSinceLastSave, 1)
+}
+
+// ParseProviders (re)loads the providers from the given json, see SetProviders.
+func (g *Geocoder) ParseProviders(jsonb []byte) (err error) {
+	servers := []*models.GeoCodeProvider{}
+	err = json.Unmarshal(jsonb, &servers)
+	if err != nil {
+		g.log.E(TAG, "Error parsing chained servers :( ", err)
+		return
+	}
+	return g.SetProviders(servers)
+}
+
+// SetProviders (re)loads the providers to chain. The request counts of providers that are already known are kept,
+// otherwise they are taken from the state file. Providers that are already known are updated in place, so requests
+// running during the reload count against the new configuration.
+func (g *Geocoder) SetProviders(servers []*models.GeoCodeProvider) (err error) {
+	g.providersMu.Lock()
+	defer g.providersMu.Unlock()
+	provNameToSave := make(map[string]*models.GeoCodeProvider)
+	provNameToState := make(map[string]*providerState)
+	if len(g.allProviders) != 0 {
+		for _, v := range g.allProviders {
+			provNameToState[v.name] = v
+		}
+	} else if g.stateFile != "" {
+		if _, _err := os.Stat(g.stateFile); _err == nil {
+			savedProviders := make([]*models.GeoCodeProvider, 0)
+			var b []byte
+			b, err = ioutil.ReadFile(g.stateFile)
+			if err != nil {
+				g.log.E(TAG, "Error reading previous provider data : ", err)
+				return
+			}
+			err = json.Unmarshal(b, &savedProviders)
+			if err != nil {
+				g.log.E(TAG, "Error parsing previous provider data : ", err)
+				return
+			}
+
+			for _, v := range savedProviders {
+				if provNameToSave[v.Name] != nil {
+					g.log.E(TAG, "Multiple providers with same name not allowed! Please correct this in Providers.json AND %s ", g.stateFile)
+					return errors.New("Multiple providers with same name not allowed! Please correct this in Providers.json AND " + g.stateFile)
+				}
+				provNameToSave[v.Name] = v
+			}
+		}
+	}
+	newChain := make([]*providerState, 0)
+	newNonChain := make([]*providerState, 0)
+	newAll := make([]*providerState, 0)
+	seen := make(map[string]bool)
+	for _, v := range servers {
+		if seen[v.Name] {
+			g.log.E(TAG, "Multiple providers with same name not allowed! Please correct this in Providers.json")
+			return errors.New("Multiple providers with same name not allowed! Please correct this in Providers.json")
+		}
+		seen[v.Name] = true
+		if _, _err := GetProviderImpl(v); _err != nil {
+			g.log.E(TAG, "Provider %s has unknown type %s - it will be skipped on requests", v.Name, ProviderTypeName(v))
+		}
+		if v.IntervalSizeInDays <= 0 && !v.IntervalMonthly && v.MaxRequestsPerInterval != 0 {
+			g.log.W(TAG, "Provider %s has neither IntervalSizeInDays nor IntervalMonthly - its MaxRequestsPerInterval is not enforced", v.Name)
+		}
+		c := *v // don't share the callers provider
+		state := provNameToState[v.Name]
+		if state != nil {
+			state.Lock()
+			copyRequestCounts(state.prov, &c)
+			*state.prov = c
+			state.Unlock()
+		} else {
+			if provNameToSave[v.Name] != nil {
+				copyRequestCounts(provNameToSave[v.Name], &c)
+				g.log.I(TAG, "Updated request counts of provider %s from %s", v.Name, g.stateFile)
+			}
+			state = &providerState{name: v.Name, prov: &c}
+		}
+		newAll = append(newAll, state)
+		if !v.Disabled {
+			newNonChain = append(newNonChain, state)
+			newChain = append(newChain, state)
+			if !v.ChainingForbidden { // Yes, this seems counter-intuitive - but if dontChain = false, we are the root-server
+				// and need to ask this provider - otherwise we don't.
+				newNonChain = append(newNonChain, state)
+			}
+		}
+	}
+	g.allProviders = newAll
+	g.chainProviders = newChain
+	g.nonChainProviders = newNonChain
+	g.markChanged()
+	return
+}
+
+// copyRequestCounts copies the automatically tracked request counts from one provider to another - the requests per
+// user are copied as well, so the providers do not share them.
+func copyRequestCounts(from *models.GeoCodeProvider, to *models.GeoCodeProvider) {
+	to.CurIntervalRequests = from.CurIntervalRequests
+	to.FirstIntervalRequest = from.FirstIntervalRequest
+	to.LastRequestTime = from.LastRequestTime
+	to.NextAllowedRequestTime = from.NextAllowedRequestTime
+	to.UsersToReqCount = make(map[string]int, len(from.UsersToReqCount))
+	for uId, cnt := range from.UsersToReqCount {
+		to.UsersToReqCount[uId] = cnt
+	}
+	to.UsersToReqCountDay = from.UsersToReqCountDay
+}
+
+// Providers returns a copy of all configured providers including their current request counts.
+func (g *Geocoder) Providers() []models.GeoCodeProvider {
+	g.providersMu.RLock()
+	defer g.providersMu.RUnlock()
+	provs := make([]models.GeoCodeProvider, len(g.allProviders))
+	for i, v := range g.allProviders {
+		provs[i] = v.copyProvider()
+	}
+	return provs
+}
+
+// Save writes the providers including their request counts to the state file, if anything changed since the last
+// save or force is set.
+func (g *Geocoder) Save(force bool) {
+	if g.stateFile == "" && g.planUsageFile == "" {
+		return
+	}
+	if atomic.SwapInt32(&g.changesSinceLastSave, 0) == 0 && !force {
+		return
+	}
+	g.saveMu.Lock()
+	defer g.saveMu.Unlock()
+	if g.planUsageFile != "" {
+		err := g.savePlanUsage(g.planUsageFile)
+		if err != nil {
+			g.log.E(TAG, "Unable to autosave plan usage : ", err)
+			g.markChanged()
+		}
+	}
+	if g.stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(g.Providers())
+	if err != nil {
+		g.log.E(TAG, "Unable to marshal providers : ", err)
+		g.markChanged()
+		return
+	}
+	// write to a temporary file first, so a crash while saving does not leave us with a broken file
+	err = ioutil.WriteFile(g.stateFile+".tmp", data, os.FileMode(0600))
+	if err == nil {
+		err = os.Rename(g.stateFile+".tmp", g.stateFile)
+	}
+	if err != nil {
+		g.log.E(TAG, "Unable to autosave providers : ", err)
+		g.markChanged()
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+const tomTomReverseBody = `{"addresses":[{"address":{"streetNumber":"101","streetName":"Walterstal","municipality":"Freiberg","postalCode":"09599","countryCode":"DE","freeformAddress":"Walterstal 101, 09599 Freiberg"}}]}`
+
+// TestParallelRequestCounts sends hundreds of parallel lookups through one Geocoder - the requests counted per provider
+// & user need to match the requests the provider got.
+func TestParallelRequestCounts(t *testing.T) {
+	var received int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	g, err := NewGeocoder(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"tomtom","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1}]`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests, users = 300, 7
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// different coordinates, so no lookup is shared with another one
+			res, err := g.Reverse(context.Background(), 50+float64(i)/100, 13, RequestOptions{UserId: fmt.Sprintf("user%d", i%users)})
+			if err != nil || res.Address.Street != "Walterstal" {
+				t.Errorf("lookup %d : %+v, %v", i, res, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	p, err := g.Provider("tomtom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CurIntervalRequests != requests || int(atomic.LoadInt32(&received)) != requests {
+		t.Errorf("CurIntervalRequests = %d, provider got %d requests, want %d", p.CurIntervalRequests, received, requests)
+	}
+	sum := 0
+	for u := 0; u < users; u++ {
+		uId := fmt.Sprintf("user%d", u)
+		want := requests / users
+		if u < requests%users {
+			want++
+		}
+		if p.UsersToReqCount[uId] != want {
+			t.Errorf("UsersToReqCount[%s] = %d, want %d", uId, p.UsersToReqCount[uId], want)
+		}
+		sum += p.UsersToReqCount[uId]
+	}
+	if sum != requests {
+		t.Errorf("sum of UsersToReqCount = %d, want %d", sum, requests)
+	}
+}
+
+// TestUserLimitResetDaily checks that the requests per user & day are reset every day, also for providers whose
+// contingent is per month.
+func TestUserLimitResetDaily(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+	g, err := NewGeocoder(Options{Now: func() time.Time { return now }, Providers: []*models.GeoCodeProvider{
+		{Name: "tomtom", TypeName: "tomtom", Uri: srv.URL, IntervalMonthly: true, MaxRequestsPerUserAndDay: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		after time.Duration // time passed since the previous step
+		err   error
+	}{
+		{"1st of the day", 0, nil},
+		{"2nd of the day", 0, nil},
+		{"user limit", time.Hour, ErrNoRequestsLeft},
+		{"next day", 12 * time.Hour, nil},
+		{"2nd of the next day", 0, nil},
+		{"user limit of the next day", 0, ErrNoRequestsLeft},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.after)
+		// different coordinates, so no result comes from the cache
+		if _, err = g.Reverse(context.Background(), 50+float64(i)/100, 13, RequestOptions{UserId: "a"}); err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if next, want := g.NextAvailable("a"), time.Date(2016, 3, 12, 0, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("NextAvailable = %v, want %v", next, want)
+	}
+	if p, _ := g.Provider("tomtom"); p.CurIntervalRequests != 4 {
+		t.Errorf("CurIntervalRequests = %d, want the 4 requests of the month", p.CurIntervalRequests)
+	}
+}
+
+// TestSetProvidersKeepsCounts checks that the request counts survive SetProviders without being written into or shared
+// with the providers of the caller.
+func TestSetProvidersKeepsCounts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	defer srv.Close()
+	g, err := NewGeocoder(Options{Providers: []*models.GeoCodeProvider{
+		{Name: "tomtom", TypeName: "tomtom", Uri: srv.URL, IntervalSizeInDays: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.Reverse(context.Background(), 50.9, 13.3, RequestOptions{UserId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	prov := &models.GeoCodeProvider{Name: "tomtom", TypeName: "tomtom", Uri: srv.URL, IntervalSizeInDays: 2}
+	if err = g.SetProviders([]*models.GeoCodeProvider{prov}); err != nil {
+		t.Fatal(err)
+	}
+	if prov.CurIntervalRequests != 0 || prov.UsersToReqCount != nil {
+		t.Errorf("counts written into the provider of the caller : %+v", prov)
+	}
+	if _, err = g.Reverse(context.Background(), 50.8, 13.3, RequestOptions{UserId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// a second update copies the counts again - they must not be shared with the previous copy
+	prov2 := *prov
+	if err = g.SetProviders([]*models.GeoCodeProvider{&prov2}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := g.Provider("tomtom")
+	if p.IntervalSizeInDays != 2 || p.CurIntervalRequests != 2 || p.UsersToReqCount["a"] != 2 {
+		t.Errorf("provider after SetProviders : %+v", p)
+	}
+	g.allProviders[0].Lock()
+	g.allProviders[0].prov.UsersToReqCount["a"] = 5
+	g.allProviders[0].Unlock()
+	if prov.UsersToReqCount["a"] != 0 || prov2.UsersToReqCount["a"] != 0 {
+		t.Errorf("requests per user shared with the providers of the caller : %v, %v", prov.UsersToReqCount, prov2.UsersToReqCount)
+	}
+}
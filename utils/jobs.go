@@ -0,0 +1,581 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrJobNotFound = errors.New("Job not found")
+var ErrJobTooBig = errors.New("Job has too many items")
+var ErrUnknownJobType = errors.New("Unknown job type")
+
+const (
+	JobReverse = "reverse"
+	JobForward = "forward"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobWaiting   = "waiting" // all providers or the plan of the user are out of requests - continues at WaitingUntil
+	JobDone      = "done"
+	JobCancelled = "cancelled"
+)
+
+// Job is a batch worked through in the background. It is persisted to a file of its own, so it survives restarts.
+type Job struct {
+	Id           string
+	Type         string // JobReverse or JobForward
+	UserId       string
+	DontChain    bool
+	Status       string
+	Created      time.Time
+	Updated      time.Time
+	WaitingUntil time.Time // only set while Status is JobWaiting
+	Total        int
+	Done         int
+	Items        []JobItem
+
+	cursor int // all items before it are done, so next does not scan them again
+}
+
+// JobItem is a single coordinate (reverse) or address (forward) of a job. Forward items have either Address or
+// Structured set.
+type JobItem struct {
+	ReqId      string
+	Lat        float64
+	Lng        float64
+	Address    string
+	Structured *StructuredAddress `json:",omitempty"`
+	Done       bool
+	Result     *JobResult `json:",omitempty"`
+}
+
+// JobResult is the result of a single JobItem. Error is empty if the lookup succeeded or just found nothing.
+type JobResult struct {
+	Address   models.Address
+	Provider  string
+	FromCache bool
+	Distance  float64
+	NoCache   bool
+	Error     string
+}
+
+// JobQueue works through jobs one item after another, so they don't take the requests of the providers from
+// interactive users all at once. If all providers are out of requests, a job waits until the next provider interval
+// rolls over. It is safe for concurrent use.
+type JobQueue struct {
+	g       *Geocoder
+	dir     string
+	ttl     time.Duration
+	maxSize int
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string // ids in the order the jobs were submitted
+
+	saveMu  sync.Mutex
+	dirty   map[string]bool        // ids of the jobs to save completely (new, finished, cancelled or removed) - guarded by mu
+	results map[string][]jobResult // results found since the last save, by job id - guarded by mu
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewJobQueue creates a queue for g and loads the jobs persisted to dir, one file per job - empty dir means jobs are
+// not persisted. If dir is the single file older versions saved all jobs to, it is converted (and kept as dir.old).
+// Finished jobs are removed after ttl (0 = never), maxSize is the max number of items per job (0 = no limit).
+func NewJobQueue(g *Geocoder, dir string, ttl time.Duration, maxSize int) (q *JobQueue, err error) {
+	q = &JobQueue{
+		g:       g,
+		dir:     dir,
+		ttl:     ttl,
+		maxSize: maxSize,
+		jobs:    make(map[string]*Job),
+		dirty:   make(map[string]bool),
+		results: make(map[string][]jobResult),
+		wake:    make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return
+	}
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		return q, q.convertJobsFile()
+	}
+	err = os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var jobs []*Job
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		j := &Job{}
+		if err == nil {
+			err = json.Unmarshal(b, j)
+		}
+		if err == nil {
+			err = q.loadResults(j)
+		}
+		if err != nil {
+			g.log.E(TAG, "Unable to load job %s : ", fi.Name(), err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	sort.SliceStable(jobs, func(a, b int) bool { return jobs[a].Created.Before(jobs[b].Created) })
+	q.addLoaded(jobs)
+	return
+}
+
+// convertJobsFile loads the single file older versions saved all jobs to & saves them to a file per job instead.
+func (q *JobQueue) convertJobsFile() (err error) {
+	b, err := ioutil.ReadFile(q.dir)
+	if err != nil {
+		return
+	}
+	var jobs []*Job
+	err = json.Unmarshal(b, &jobs)
+	if err != nil {
+		return
+	}
+	err = os.Rename(q.dir, q.dir+".old")
+	if err == nil {
+		err = os.MkdirAll(q.dir, os.FileMode(0700))
+	}
+	if err != nil {
+		return
+	}
+	q.addLoaded(jobs)
+	q.Save(true)
+	return
+}
+
+// addLoaded adds persisted jobs - the ones that were worked on are queued again.
+func (q *JobQueue) addLoaded(jobs []*Job) {
+	for _, j := range jobs {
+		if j.Status == JobRunning || j.Status == JobWaiting {
+			j.Status = JobQueued
+		}
+		q.jobs[j.Id] = j
+		q.order = append(q.order, j.Id)
+	}
+}
+
+// Start starts working through the queue in the background.
+func (q *JobQueue) Start() {
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	q.done = make(chan struct{})
+	go q.run(ctx)
+}
+
+// Stop stops working through the queue after the current item and persists the changed jobs.
+func (q *JobQueue) Stop() {
+	if q.cancel != nil {
+		q.cancel()
+		<-q.done
+	}
+	q.Save(false)
+}
+
+// Submit adds a job - only Type, UserId, DontChain and Items need to be set. It returns the id of the job.
+func (q *JobQueue) Submit(job Job) (id string, err error) {
+	if job.Type != JobReverse && job.Type != JobForward {
+		return "", ErrUnknownJobType
+	}
+	if q.maxSize > 0 && len(job.Items) > q.maxSize {
+		return "", ErrJobTooBig
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	now := q.g.now()
+	j := &Job{
+		Id:        hex.EncodeToString(b),
+		Type:      job.Type,
+		UserId:    job.UserId,
+		DontChain: job.DontChain,
+		Status:    JobQueued,
+		Created:   now,
+		Updated:   now,
+		Total:     len(job.Items),
+		Items:     make([]JobItem, len(job.Items)),
+	}
+	for i, it := range job.Items {
+		j.Items[i] = JobItem{ReqId: it.ReqId, Lat: it.Lat, Lng: it.Lng, Address: it.Address, Structured: it.Structured}
+	}
+	if j.Total == 0 {
+		j.Status = JobDone
+	}
+	q.mu.Lock()
+	q.jobs[j.Id] = j
+	q.order = append(q.order, j.Id)
+	q.dirty[j.Id] = true
+	q.mu.Unlock()
+	q.Save(false)
+	q.notify()
+	return j.Id, nil
+}
+
+// Get returns a copy of the job with the given id.
+func (q *JobQueue) Get(id string) (job Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.jobs[id]
+	if j == nil {
+		return job, ErrJobNotFound
+	}
+	job = *j
+	job.Items = append([]JobItem{}, j.Items...)
+	return
+}
+
+// Cancel stops working on the job with the given id - results found so far are kept.
+func (q *JobQueue) Cancel(id string) (err error) {
+	q.mu.Lock()
+	j := q.jobs[id]
+	if j == nil {
+		q.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if j.Status != JobDone {
+		j.Status = JobCancelled
+		j.WaitingUntil = time.Time{}
+		j.Updated = q.g.now()
+		q.dirty[id] = true
+	}
+	q.mu.Unlock()
+	q.Save(false)
+	return
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run works on the oldest job that is not waiting, until ctx is done.
+func (q *JobQueue) run(ctx context.Context) {
+	defer close(q.done)
+	lastSave := time.Now()
+	for ctx.Err() == nil {
+		j, idx, ok, wait := q.next()
+		if !ok {
+			q.Save(false)
+			lastSave = time.Now()
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		res, err := q.lookup(ctx, j, idx)
+		if ctx.Err() != nil {
+			break
+		}
+		q.finishItem(j, idx, res, err)
+		if time.Since(lastSave) > 15*time.Second {
+			q.Save(false)
+			lastSave = time.Now()
+		}
+	}
+}
+
+// next returns the next item to work on. If there is none, wait is how long to sleep before checking again.
+// Items are worked through in order, so the scan for the next item starts at the cursor of the job.
+func (q *JobQueue) next() (job Job, idx int, ok bool, wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.g.now()
+	wait = time.Hour
+	var remove []string
+	for _, id := range q.order {
+		j := q.jobs[id]
+		if j.Status == JobDone || j.Status == JobCancelled {
+			if q.ttl > 0 && now.Sub(j.Updated) > q.ttl {
+				remove = append(remove, id)
+			}
+			continue
+		}
+		if j.Status == JobWaiting {
+			if d := j.WaitingUntil.Sub(now); d > 0 {
+				if d < wait {
+					wait = d
+				}
+				continue
+			}
+		}
+		for ; j.cursor < len(j.Items); j.cursor++ {
+			if !j.Items[j.cursor].Done {
+				// running & waiting are not saved - such jobs are queued again after a restart anyway
+				j.Status = JobRunning
+				j.WaitingUntil = time.Time{}
+				q.removeJobs(remove)
+				return *j, j.cursor, true, 0
+			}
+		}
+		j.Status = JobDone
+		q.dirty[id] = true
+	}
+	q.removeJobs(remove)
+	return Job{}, 0, false, wait
+}
+
+func (q *JobQueue) removeJobs(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	for _, id := range ids {
+		delete(q.jobs, id)
+		q.dirty[id] = true
+	}
+	order := q.order[:0]
+	for _, id := range q.order {
+		if q.jobs[id] != nil {
+			order = append(order, id)
+		}
+	}
+	q.order = order
+}
+
+func (q *JobQueue) lookup(ctx context.Context, j Job, idx int) (Result, error) {
+	opts := RequestOptions{UserId: j.UserId, DontChain: j.DontChain}
+	it := j.Items[idx]
+	if j.Type == JobForward {
+		if it.Structured != nil && it.Structured.String() != "" {
+			return q.g.ForwardStructured(ctx, *it.Structured, opts)
+		}
+		if it.Address == "" {
+			return Result{}, ErrEmptyQuery
+		}
+		return q.g.Forward(ctx, it.Address, opts)
+	}
+	return q.g.Reverse(ctx, it.Lat, it.Lng, opts)
+}
+
+// finishItem stores the result of an item - or lets the job wait for the providers if they are out of requests.
+func (q *JobQueue) finishItem(job Job, idx int, res Result, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.jobs[job.Id]
+	if j == nil || j.Status != JobRunning {
+		return // cancelled meanwhile
+	}
+	now := q.g.now()
+	j.Updated = now
+	if err == ErrNoRequestsLeft || err == ErrPlanLimitReached {
+		j.Status = JobWaiting
+		if err == ErrPlanLimitReached {
+			j.WaitingUntil = q.g.PlanReset(j.UserId)
+		} else {
+			j.WaitingUntil = q.g.NextAvailable(j.UserId)
+		}
+		if j.WaitingUntil.IsZero() {
+			j.WaitingUntil = now.Add(time.Hour)
+		}
+		q.g.log.I(TAG, "Job %s is out of requests, waiting until %v", j.Id, j.WaitingUntil)
+		return
+	}
+	r := &JobResult{Address: res.Address, Provider: res.Provider, FromCache: res.FromCache, Distance: res.Distance, NoCache: res.NoCache}
+	if err != nil && err != ErrEmptyResult {
+		r.Error = err.Error()
+	}
+	j.Items[idx].Done = true
+	j.Items[idx].Result = r
+	j.Done++
+	if j.Done >= j.Total {
+		j.Status = JobDone
+		q.dirty[j.Id] = true
+	} else if !r.NoCache {
+		q.results[j.Id] = append(q.results[j.Id], jobResult{Idx: idx, Result: r})
+	}
+}
+
+// jobResult is a line of the results file of a job - the result of a single item found after the job file was written.
+type jobResult struct {
+	Idx    int
+	Result *JobResult
+}
+
+// Save persists the jobs that changed since the last save - or all jobs if force is set. Every job has a file of its
+// own, which is only rewritten if the job is new, finished, cancelled or removed. Results found in between are appended
+// to a results file next to it, so a running job does not rewrite all of its items on every save.
+func (q *JobQueue) Save(force bool) {
+	if q.dir == "" {
+		return
+	}
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.mu.Lock()
+	if force {
+		for id := range q.jobs {
+			q.dirty[id] = true
+		}
+	}
+	data := make(map[string][]byte, len(q.dirty))
+	results := make(map[string][]byte, len(q.results))
+	for id, rs := range q.results {
+		if q.dirty[id] {
+			continue // the job file holds the results
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, r := range rs {
+			if err := enc.Encode(r); err != nil {
+				q.g.log.E(TAG, "Unable to save results of job %s : ", id, err)
+			}
+		}
+		results[id] = buf.Bytes()
+	}
+	q.results = make(map[string][]jobResult)
+	for id := range q.dirty {
+		if j := q.jobs[id]; j != nil {
+			b, err := json.Marshal(persistedJob(j))
+			if err != nil {
+				q.g.log.E(TAG, "Unable to save job %s : ", id, err)
+				continue
+			}
+			data[id] = b
+		} else {
+			data[id] = nil // removed
+		}
+	}
+	q.dirty = make(map[string]bool)
+	q.mu.Unlock()
+
+	for id, b := range data {
+		err := q.writeJob(id, b)
+		if err != nil {
+			q.g.log.E(TAG, "Unable to save job %s : ", id, err)
+			q.mu.Lock()
+			q.dirty[id] = true
+			q.mu.Unlock()
+		}
+	}
+	for id, b := range results {
+		err := q.appendResults(id, b)
+		if err != nil {
+			q.g.log.E(TAG, "Unable to save results of job %s : ", id, err)
+			q.mu.Lock()
+			q.dirty[id] = true
+			q.mu.Unlock()
+		}
+	}
+}
+
+// persistedJob returns the job as it may be saved - results whose provider does not allow to store them (NoCache) are
+// left out, those items are looked up again if the job is loaded after a restart.
+func persistedJob(j *Job) *Job {
+	var p *Job
+	for i, it := range j.Items {
+		if it.Result == nil || !it.Result.NoCache {
+			continue
+		}
+		if p == nil {
+			c := *j
+			c.Items = append([]JobItem{}, j.Items...)
+			if c.Status == JobDone {
+				c.Status = JobQueued
+			}
+			p = &c
+		}
+		p.Items[i].Done = false
+		p.Items[i].Result = nil
+		p.Done--
+	}
+	if p == nil {
+		return j
+	}
+	return p
+}
+
+// writeJob replaces the file of the job with data & removes its results file, or removes both if data is nil.
+func (q *JobQueue) writeJob(id string, data []byte) (err error) {
+	file := filepath.Join(q.dir, id+".json")
+	if data == nil {
+		err = os.Remove(file)
+	} else {
+		// write to a temporary file first, so a crash while saving does not leave us with a broken file
+		err = ioutil.WriteFile(file+".tmp", data, os.FileMode(0600))
+		if err == nil {
+			err = os.Rename(file+".tmp", file)
+		}
+	}
+	if err == nil || os.IsNotExist(err) {
+		err = os.Remove(q.resultsFile(id))
+	}
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+func (q *JobQueue) resultsFile(id string) string {
+	return filepath.Join(q.dir, id+".results")
+}
+
+// appendResults appends lines of jobResult to the results file of the job.
+func (q *JobQueue) appendResults(id string, data []byte) (err error) {
+	f, err := os.OpenFile(q.resultsFile(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	return
+}
+
+// loadResults applies the results file of a job that was just read from its job file. A line cut off by a crash
+// while saving is ignored, its item is looked up again.
+func (q *JobQueue) loadResults(j *Job) (err error) {
+	f, err := os.Open(q.resultsFile(j.Id))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var r jobResult
+		if json.Unmarshal(sc.Bytes(), &r) != nil || r.Result == nil || r.Idx < 0 || r.Idx >= len(j.Items) {
+			continue
+		}
+		if !j.Items[r.Idx].Done {
+			j.Items[r.Idx].Done = true
+			j.Items[r.Idx].Result = r.Result
+			j.Done++
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobsServer is a tomtom provider that records the latitudes it was asked for.
+type jobsServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	lats []string
+}
+
+func newJobsServer(t *testing.T) (*jobsServer, *Geocoder) {
+	s := &jobsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /reverseGeocode/LAT,LNG.JSON
+		lat := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/reverseGeocode/"), ",", 2)[0]
+		s.mu.Lock()
+		s.lats = append(s.lats, strings.TrimRight(strings.TrimRight(lat, "0"), "."))
+		s.mu.Unlock()
+		fmt.Fprint(w, tomTomReverseBody)
+	}))
+	t.Cleanup(s.Close)
+	g, err := NewGeocoder(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ParseProviders([]byte(fmt.Sprintf(`[{"Name":"tomtom","TypeName":"tomtom","Uri":%q,"IntervalSizeInDays":1}]`, s.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, g
+}
+
+func (s *jobsServer) asked() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.lats, " ")
+}
+
+func reverseJob(lats ...float64) Job {
+	j := Job{Type: JobReverse, UserId: "u"}
+	for _, lat := range lats {
+		j.Items = append(j.Items, JobItem{Lat: lat, Lng: 13})
+	}
+	return j
+}
+
+// waitForJob waits until the job has the given status.
+func waitForJob(t *testing.T, q *JobQueue, id string, status string) Job {
+	for i := 0; i < 200; i++ {
+		j, err := q.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == status {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	j, _ := q.Get(id)
+	t.Fatalf("job %s is %s, want %s", id, j.Status, status)
+	return j
+}
+
+func TestJobQueueOrder(t *testing.T) {
+	srv, g := newJobsServer(t)
+	q, err := NewJobQueue(g, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := q.Submit(reverseJob(1, 2, 3))
+	second, _ := q.Submit(reverseJob(4, 5))
+	q.Start()
+	defer q.Stop()
+
+	waitForJob(t, q, first, JobDone)
+	j := waitForJob(t, q, second, JobDone)
+	if got := srv.asked(); got != "1 2 3 4 5" {
+		t.Errorf("provider asked for %s, want the items of the jobs in order", got)
+	}
+	if j.Done != 2 || j.Items[1].Result == nil || j.Items[1].Result.Address.Street != "Walterstal" {
+		t.Errorf("second job : %+v", j)
+	}
+}
+
+func TestJobQueueResumesAfterRestart(t *testing.T) {
+	srv, g := newJobsServer(t)
+	dir := filepath.Join(t.TempDir(), "jobs")
+	q, err := NewJobQueue(g, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := q.Submit(reverseJob(1, 2, 3, 4))
+	// work on the first two items only, like a queue stopped in between
+	for i := 0; i < 2; i++ {
+		j, idx, ok, _ := q.next()
+		if !ok {
+			t.Fatal("no item to work on")
+		}
+		res, err := q.lookup(context.Background(), j, idx)
+		q.finishItem(j, idx, res, err)
+	}
+	q.Save(false)
+	if _, err = os.Stat(q.resultsFile(id)); err != nil {
+		t.Errorf("results of the running job not appended : %v", err)
+	}
+
+	q, err = NewJobQueue(g, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := q.Get(id); j.Status != JobQueued || j.Done != 2 || !j.Items[1].Done || j.Items[2].Done {
+		t.Fatalf("job after restart : %+v", j)
+	}
+	q.Start()
+	j := waitForJob(t, q, id, JobDone)
+	q.Stop()
+	if got := srv.asked(); got != "1 2 3 4" {
+		t.Errorf("provider asked for %s, want every item once", got)
+	}
+	if j.Done != 4 {
+		t.Errorf("job done with %d items, want 4", j.Done)
+	}
+	// the finished job is saved completely
+	if _, err = os.Stat(q.resultsFile(id)); !os.IsNotExist(err) {
+		t.Errorf("results file of the finished job kept : %v", err)
+	}
+	q, _ = NewJobQueue(g, dir, 0, 0)
+	if j, _ := q.Get(id); j.Status != JobDone || j.Done != 4 {
+		t.Errorf("finished job after restart : %+v", j)
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	srv, g := newJobsServer(t)
+	dir := filepath.Join(t.TempDir(), "jobs")
+	q, err := NewJobQueue(g, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, _ := q.Submit(reverseJob(1, 2))
+	other, _ := q.Submit(reverseJob(3))
+	if err = q.Cancel(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Cancel("unknown"); err != ErrJobNotFound {
+		t.Errorf("Cancel of an unknown job = %v, want %v", err, ErrJobNotFound)
+	}
+	q.Start()
+	waitForJob(t, q, other, JobDone)
+	q.Stop()
+	if got := srv.asked(); got != "3" {
+		t.Errorf("provider asked for %s, want only the item of the other job", got)
+	}
+
+	q, _ = NewJobQueue(g, dir, 0, 0)
+	if j, _ := q.Get(cancelled); j.Status != JobCancelled || j.Done != 0 {
+		t.Errorf("cancelled job after restart : %+v", j)
+	}
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnauthorized = errors.New("Unknown API key")
+var ErrForbidden = errors.New("API key not allowed")
+
+// ApiKey is a key of the KeyStore - only the hash of the key itself is kept.
+type ApiKey struct {
+	Hash     string // sha256 of the key, hex encoded
+	UserId   string // user the key belongs to
+	Admin    bool   // may call the admin endpoints, e.g. /reparseChain
+	Chain    bool   // key of a chaining odl-geocoder - may send requests for any user id
+	Disabled bool
+	Created  time.Time
+	Comment  string
+}
+
+// KeyStore maps API keys to users, persisted to a json file. It is safe for concurrent use.
+type KeyStore struct {
+	mu   sync.RWMutex
+	file string
+	keys map[string]ApiKey // by hash
+}
+
+// HashKey returns the hash a key is stored with. The keys are random, so a plain sha256 is good enough.
+func HashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// OpenKeyStore loads the keys from file - it is created on the first AddKey if it does not exist.
+func OpenKeyStore(file string) (s *KeyStore, err error) {
+	s = &KeyStore{file: file}
+	err = s.Reload()
+	return
+}
+
+// Reload reads the keys from the file again, e.g. after it was edited by hand.
+func (s *KeyStore) Reload() (err error) {
+	keys := make(map[string]ApiKey)
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		var list []ApiKey
+		err = json.Unmarshal(b, &list)
+		if err != nil {
+			return
+		}
+		for _, k := range list {
+			keys[k.Hash] = k
+		}
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns the key, if it may be used for requests of userId. Unknown keys give ErrUnauthorized, disabled
+// keys and keys of other users ErrForbidden. userId is not checked for keys of chaining geocoders.
+func (s *KeyStore) Authenticate(userId string, key string) (k ApiKey, err error) {
+	if key == "" {
+		return k, ErrUnauthorized
+	}
+	s.mu.RLock()
+	k, ok := s.keys[HashKey(key)]
+	s.mu.RUnlock()
+	if !ok {
+		return k, ErrUnauthorized
+	}
+	if k.Disabled || (!k.Chain && userId != k.UserId) {
+		return k, ErrForbidden
+	}
+	return
+}
+
+// AuthenticateAdmin returns the key, if it may be used for the admin endpoints.
+func (s *KeyStore) AuthenticateAdmin(key string) (k ApiKey, err error) {
+	if key == "" {
+		return k, ErrUnauthorized
+	}
+	s.mu.RLock()
+	k, ok := s.keys[HashKey(key)]
+	s.mu.RUnlock()
+	if !ok {
+		return k, ErrUnauthorized
+	}
+	if k.Disabled || !k.Admin {
+		return k, ErrForbidden
+	}
+	return
+}
+
+// AddKey creates a new random key for the user, saves it and returns the key - it can not be retrieved later on.
+func (s *KeyStore) AddKey(k ApiKey) (key string, err error) {
+	b := make([]byte, 24)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	key = hex.EncodeToString(b)
+	k.Hash = HashKey(key)
+	if k.Created.IsZero() {
+		k.Created = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.Hash] = k
+	err = s.save()
+	if err != nil {
+		delete(s.keys, k.Hash)
+		key = ""
+	}
+	return
+}
+
+// save writes all keys to the file - the caller needs to hold the lock.
+func (s *KeyStore) save() (err error) {
+	list := make([]ApiKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return
+	}
+	// write to a temporary file first, so a crash while saving does not leave us with a broken file
+	err = ioutil.WriteFile(s.file+".tmp", data, os.FileMode(0600))
+	if err == nil {
+		err = os.Rename(s.file+".tmp", s.file)
+	}
+	return
+}
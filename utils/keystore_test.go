@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	if got, want := HashKey("abc"), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+		t.Errorf("HashKey(abc) = %s, want %s", got, want)
+	}
+	if HashKey("abc") == HashKey("abd") {
+		t.Error("different keys with the same hash")
+	}
+}
+
+func TestKeyStoreAuthenticate(t *testing.T) {
+	s, err := OpenKeyStore(filepath.Join(t.TempDir(), "ApiKeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := s.AddKey(ApiKey{UserId: "a"})
+	admin, _ := s.AddKey(ApiKey{UserId: "ops", Admin: true})
+	chain, _ := s.AddKey(ApiKey{Chain: true})
+	if user == "" || admin == "" || chain == "" || user == admin {
+		t.Fatalf("keys %q, %q, %q", user, admin, chain)
+	}
+
+	tests := []struct {
+		name  string
+		admin bool // AuthenticateAdmin instead of Authenticate
+		uId   string
+		key   string
+		err   error
+	}{
+		{"own key", false, "a", user, nil},
+		{"key of another user", false, "b", user, ErrForbidden},
+		{"no key", false, "a", "", ErrUnauthorized},
+		{"unknown key", false, "a", "wrong", ErrUnauthorized},
+		{"hash instead of key", false, "a", HashKey(user), ErrUnauthorized},
+		{"chain key for any user", false, "b", chain, nil},
+		{"admin key", true, "", admin, nil},
+		{"user key as admin", true, "", user, ErrForbidden},
+		{"unknown admin key", true, "", "wrong", ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		var k ApiKey
+		if tt.admin {
+			k, err = s.AuthenticateAdmin(tt.key)
+		} else {
+			k, err = s.Authenticate(tt.uId, tt.key)
+		}
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && k.Hash != HashKey(tt.key) {
+			t.Errorf("%s : got key %+v", tt.name, k)
+		}
+	}
+}
+
+func TestKeyStorePersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ApiKeys.json")
+	s, err := OpenKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.AddKey(ApiKey{UserId: "a", Comment: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := s.AddKey(ApiKey{UserId: "b"})
+
+	// only the hashes are saved, readable by us only
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), key) || !strings.Contains(string(b), HashKey(key)) {
+		t.Errorf("key file does not only contain the hash : %s", b)
+	}
+	if fi, _ := os.Stat(file); fi.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	s, err = OpenKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := s.Authenticate("a", key); err != nil || k.Comment != "test" || k.Created.IsZero() {
+		t.Errorf("key after reopening : %+v, %v", k, err)
+	}
+
+	// revoke the key by disabling it in the file
+	var keys []ApiKey
+	if err = json.Unmarshal(b, &keys); err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		keys[i].Disabled = keys[i].Hash == HashKey(key)
+	}
+	b, _ = json.Marshal(keys)
+	if err = ioutil.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Authenticate("a", key); err != nil {
+		t.Errorf("key disabled before the reload : %v", err)
+	}
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Authenticate("a", key); err != ErrForbidden {
+		t.Errorf("disabled key : err = %v, want %v", err, ErrForbidden)
+	}
+	if _, err = s.Authenticate("b", other); err != nil {
+		t.Errorf("other key after the reload : %v", err)
+	}
+
+	// a broken file keeps the keys loaded before
+	ioutil.WriteFile(file, []byte("[{"), 0600)
+	if err = s.Reload(); err == nil {
+		t.Error("broken key file loaded")
+	}
+	if _, err = s.Authenticate("b", other); err != nil {
+		t.Errorf("other key after a failed reload : %v", err)
+	}
+}
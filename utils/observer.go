@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"time"
+)
+
+// Outcomes of a single request to a provider, as passed to Observer.ProviderRequest.
+const (
+	OutcomeSuccess = "success"      // the provider returned an address
+	OutcomeEmpty   = "empty"        // the provider returned no result
+	OutcomeSkip    = "skip"         // the provider was not asked, e.g. because its contingent is used up
+	OutcomeNeedFix = "need_fix"     // ErrNeedFixBeforeRetry - the provider is paused for an hour
+	OutcomeLimited = "rate_limited" // ErrRateLimited - the provider asked us to wait (http 429 or 402)
+	OutcomeError   = "error"        // any other error
+)
+
+// Results of a cache lookup, as passed to Observer.CacheLookup.
+const (
+	CacheHit    = "hit"    // exact cache hit
+	CacheNearby = "nearby" // answered by a cached reverse lookup within NearbyRadius
+	CacheMiss   = "miss"
+)
+
+// Observer is notified about what the Geocoder does, e.g. to export metrics. Implementations need to be safe for
+// concurrent use and should return quickly, as they are called while handling requests.
+type Observer interface {
+	// ProviderRequest is called for every provider the Geocoder tried for a lookup. latency is 0 if no request was sent.
+	ProviderRequest(provider string, outcome string, latency time.Duration)
+	// CacheLookup is called for every lookup if the cache is enabled, with CacheHit, CacheNearby or CacheMiss.
+	CacheLookup(result string)
+}
+
+// noopObserver is the default Observer, ignoring everything.
+type noopObserver struct{}
+
+func (noopObserver) ProviderRequest(provider string, outcome string, latency time.Duration) {}
+func (noopObserver) CacheLookup(result string)                                              {}
+
+// outcomeOf returns the outcome of a provider request that returned err.
+func outcomeOf(err error) string {
+	switch err {
+	case nil:
+		return OutcomeSuccess
+	case ErrEmptyResult:
+		return OutcomeEmpty
+	case ErrSkipProvider:
+		return OutcomeSkip
+	case ErrNeedFixBeforeRetry:
+		return OutcomeNeedFix
+	case ErrRateLimited:
+		return OutcomeLimited
+	}
+	return OutcomeError
+}
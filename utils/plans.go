@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var ErrPlanLimitReached = errors.New("Request limit of the plan reached")
+var ErrUnknownPlan = errors.New("Unknown plan")
+
+// Plan limits the requests of the users assigned to it. Only lookups that reach a provider count, cached ones don't.
+type Plan struct {
+	Name                string
+	MaxRequestsPerDay   int      // 0 = no limit besides the ones of the providers
+	MaxRequestsPerMonth int      // 0 = no limit besides the ones of the providers
+	Providers           []string // names of the providers the plan may use, empty = all
+}
+
+// PlanConfig are the plans and which user has which of them, usually parsed from Plans.json.
+type PlanConfig struct {
+	Default string // plan of users not in Users, empty = no limits
+	Plans   []Plan
+	Users   map[string]string // user id to plan name
+}
+
+// PlanUsage are the requests a user made in the current day & month (UTC).
+type PlanUsage struct {
+	Day        string // 2006-01-02
+	DayCount   int
+	Month      string // 2006-01
+	MonthCount int
+}
+
+// planState holds the plans of a Geocoder - guarded by Geocoder.plansMu.
+type planState struct {
+	def   string
+	plans map[string]Plan
+	users map[string]string
+	usage map[string]*PlanUsage
+}
+
+// ParsePlans parses the plans from json (see PlanConfig) and uses them from now on.
+func (g *Geocoder) ParsePlans(jsonb []byte) (err error) {
+	var cfg PlanConfig
+	err = json.Unmarshal(jsonb, &cfg)
+	if err != nil {
+		g.log.E(TAG, "Error unmarshaling plans : ", err)
+		return
+	}
+	return g.SetPlans(cfg)
+}
+
+// SetPlans uses the given plans from now on - the usage of the users is kept.
+func (g *Geocoder) SetPlans(cfg PlanConfig) (err error) {
+	plans := make(map[string]Plan, len(cfg.Plans))
+	for _, p := range cfg.Plans {
+		plans[p.Name] = p
+	}
+	if _, ok := plans[cfg.Default]; cfg.Default != "" && !ok {
+		g.log.E(TAG, "Default plan %s does not exist", cfg.Default)
+		return ErrUnknownPlan
+	}
+	for uId, name := range cfg.Users {
+		if _, ok := plans[name]; !ok {
+			g.log.E(TAG, "Plan %s of user %s does not exist", name, uId)
+			return ErrUnknownPlan
+		}
+	}
+	users := make(map[string]string, len(cfg.Users))
+	for uId, name := range cfg.Users {
+		users[uId] = name
+	}
+	g.plansMu.Lock()
+	g.plans.def = cfg.Default
+	g.plans.plans = plans
+	g.plans.users = users
+	g.plansMu.Unlock()
+	return
+}
+
+// PlanOf returns the plan of the user - ok is false if the user has none.
+func (g *Geocoder) PlanOf(uId string) (p Plan, ok bool) {
+	g.plansMu.RLock()
+	defer g.plansMu.RUnlock()
+	return g.planOf(uId)
+}
+
+// planOf is PlanOf for callers holding plansMu.
+func (g *Geocoder) planOf(uId string) (p Plan, ok bool) {
+	name, ok := g.plans.users[uId]
+	if !ok {
+		name = g.plans.def
+	}
+	p, ok = g.plans.plans[name]
+	return
+}
+
+// PlanUsage returns the requests the user made in the current day & month.
+func (g *Geocoder) PlanUsage(uId string) (u PlanUsage) {
+	g.plansMu.RLock()
+	defer g.plansMu.RUnlock()
+	return g.planUsage(uId, g.now())
+}
+
+// planUsage returns the usage of the user, with the counts of past days / months reset. The caller needs to hold plansMu.
+func (g *Geocoder) planUsage(uId string, now time.Time) (u PlanUsage) {
+	if cur := g.plans.usage[uId]; cur != nil {
+		u = *cur
+	}
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+	return
+}
+
+// checkPlan reserves a request of the plan of the user at now, so concurrent lookups can not exceed its limits - it
+// returns ErrPlanLimitReached if the user used up the daily or monthly requests of the plan. If the lookup does not
+// reach a provider, the request needs to be given back with releasePlanRequest.
+func (g *Geocoder) checkPlan(uId string, now time.Time) (p Plan, hasPlan bool, err error) {
+	g.plansMu.Lock()
+	defer g.plansMu.Unlock()
+	p, hasPlan = g.planOf(uId)
+	if !hasPlan {
+		return
+	}
+	u := g.planUsage(uId, now)
+	if (p.MaxRequestsPerDay > 0 && u.DayCount >= p.MaxRequestsPerDay) ||
+		(p.MaxRequestsPerMonth > 0 && u.MonthCount >= p.MaxRequestsPerMonth) {
+		g.log.I(TAG, "User %s used up the requests of plan %s", uId, p.Name)
+		err = ErrPlanLimitReached
+		return
+	}
+	u.DayCount++
+	u.MonthCount++
+	if g.plans.usage == nil {
+		g.plans.usage = make(map[string]*PlanUsage)
+	}
+	g.plans.usage[uId] = &u
+	g.markChanged()
+	return
+}
+
+// releasePlanRequest gives back a request checkPlan reserved at reservedAt - counts of a day or month that is over
+// by now are left alone.
+func (g *Geocoder) releasePlanRequest(uId string, reservedAt time.Time) {
+	g.plansMu.Lock()
+	defer g.plansMu.Unlock()
+	if _, ok := g.planOf(uId); !ok {
+		return
+	}
+	u := g.plans.usage[uId]
+	if u == nil {
+		return
+	}
+	reservedAt = reservedAt.UTC()
+	if u.Day == reservedAt.Format("2006-01-02") && u.DayCount > 0 {
+		u.DayCount--
+	}
+	if u.Month == reservedAt.Format("2006-01") && u.MonthCount > 0 {
+		u.MonthCount--
+	}
+	g.markChanged()
+}
+
+// PlanReset returns when the requests of the plan of the user are available again after ErrPlanLimitReached - the
+// start of the next day or month (UTC).
+func (g *Geocoder) PlanReset(uId string) time.Time {
+	g.plansMu.RLock()
+	defer g.plansMu.RUnlock()
+	p, _ := g.planOf(uId)
+	now := g.now().UTC()
+	u := g.planUsage(uId, now)
+	if p.MaxRequestsPerMonth > 0 && u.MonthCount >= p.MaxRequestsPerMonth {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// userAccess tells which providers a user may use - by the plan of the user and the allow & deny lists of the providers.
+type userAccess struct {
+	uId     string
+	plan    Plan
+	hasPlan bool
+}
+
+// accessOf returns the access of the user.
+func (g *Geocoder) accessOf(uId string) userAccess {
+	p, ok := g.PlanOf(uId)
+	return userAccess{uId: uId, plan: p, hasPlan: ok}
+}
+
+// allows tells if the user may use the provider with the given name - the caller needs to hold the lock of prov.
+func (a userAccess) allows(name string, prov *models.GeoCodeProvider) bool {
+	if a.hasPlan && len(a.plan.Providers) != 0 && !contains(a.plan.Providers, name) {
+		return false
+	}
+	planName := ""
+	if a.hasPlan {
+		planName = a.plan.Name
+	}
+	if contains(prov.DeniedUsers, a.uId) || (planName != "" && contains(prov.DeniedPlans, planName)) {
+		return false
+	}
+	if len(prov.AllowedUsers) == 0 && len(prov.AllowedPlans) == 0 {
+		return true
+	}
+	return contains(prov.AllowedUsers, a.uId) || (planName != "" && contains(prov.AllowedPlans, planName))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPlanUsage restores the usage of the users from file.
+func (g *Geocoder) loadPlanUsage(file string) (err error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	usage := make(map[string]*PlanUsage)
+	err = json.Unmarshal(b, &usage)
+	if err != nil {
+		return
+	}
+	g.plansMu.Lock()
+	g.plans.usage = usage
+	g.plansMu.Unlock()
+	return
+}
+
+// savePlanUsage writes the usage of the users to file. The caller needs to hold saveMu.
+func (g *Geocoder) savePlanUsage(file string) (err error) {
+	g.plansMu.RLock()
+	data, err := json.Marshal(g.plans.usage)
+	g.plansMu.RUnlock()
+	if err != nil {
+		return
+	}
+	// write to a temporary file first, so a crash while saving does not leave us with a broken file
+	err = ioutil.WriteFile(file+".tmp", data, os.FileMode(0600))
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	return
+}
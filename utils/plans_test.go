@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func newPlansGeocoder(t *testing.T, now *time.Time) *Geocoder {
+	g, err := NewGeocoder(Options{Now: func() time.Time { return *now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.SetPlans(PlanConfig{
+		Default: "free",
+		Plans: []Plan{
+			{Name: "free", MaxRequestsPerDay: 2, MaxRequestsPerMonth: 3},
+			{Name: "pro", Providers: []string{"tomtom"}},
+		},
+		Users: map[string]string{"paying": "pro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestPlanLimits(t *testing.T) {
+	now := time.Date(2016, 3, 31, 12, 0, 0, 0, time.UTC)
+	g := newPlansGeocoder(t, &now)
+
+	tests := []struct {
+		name  string
+		uId   string
+		after time.Duration // time passed since the previous step
+		err   error
+	}{
+		{"1st of the day", "a", 0, nil},
+		{"2nd of the day", "a", 0, nil},
+		{"daily limit", "a", 0, ErrPlanLimitReached},
+		{"other user", "b", 0, nil},
+		{"next day, next month", "a", 24 * time.Hour, nil},
+		{"2nd of the day", "a", 0, nil},
+		{"next day", "a", 24 * time.Hour, nil},
+		{"monthly limit", "a", 24 * time.Hour, ErrPlanLimitReached},
+		{"no limits", "paying", 0, nil},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		if _, _, err := g.checkPlan(tt.uId, now); err != tt.err {
+			t.Errorf("%s : checkPlan(%s) = %v, want %v", tt.name, tt.uId, err, tt.err)
+		}
+	}
+	if u := g.PlanUsage("a"); u.Day != "2016-04-03" || u.DayCount != 0 || u.Month != "2016-04" || u.MonthCount != 3 {
+		t.Errorf("PlanUsage(a) = %+v", u)
+	}
+	if reset := g.PlanReset("a"); !reset.Equal(time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("PlanReset(a) = %v, want start of May", reset)
+	}
+}
+
+func TestPlanReleaseRequest(t *testing.T) {
+	now := time.Date(2016, 3, 30, 23, 0, 0, 0, time.UTC)
+	g := newPlansGeocoder(t, &now)
+
+	reservedAt := now
+	g.checkPlan("a", reservedAt)
+	g.checkPlan("a", reservedAt)
+	g.releasePlanRequest("a", reservedAt)
+	if u := g.PlanUsage("a"); u.DayCount != 1 || u.MonthCount != 1 {
+		t.Errorf("usage after release = %+v, want 1 request", u)
+	}
+
+	// a release after midnight leaves the count of the new day alone
+	now = now.Add(2 * time.Hour)
+	g.checkPlan("a", now)
+	g.releasePlanRequest("a", reservedAt)
+	if u := g.PlanUsage("a"); u.DayCount != 1 || u.MonthCount != 1 {
+		t.Errorf("usage after release of the previous day = %+v, want 1 request", u)
+	}
+}
+
+func TestPlanConcurrentReservations(t *testing.T) {
+	now := time.Date(2016, 3, 30, 12, 0, 0, 0, time.UTC)
+	g := newPlansGeocoder(t, &now)
+
+	var ok int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := g.checkPlan("a", now); err == nil {
+				atomic.AddInt32(&ok, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 2 {
+		t.Errorf("%d concurrent requests passed the plan, want 2", ok)
+	}
+}
+
+func TestUserAccessAllows(t *testing.T) {
+	free := Plan{Name: "free"}
+	pro := Plan{Name: "pro", Providers: []string{"tomtom"}}
+	tests := []struct {
+		name   string
+		access userAccess
+		prov   models.GeoCodeProvider
+		allows bool
+	}{
+		{"no plan, no lists", userAccess{uId: "a"}, models.GeoCodeProvider{}, true},
+		{"provider of the plan", userAccess{uId: "a", plan: pro, hasPlan: true}, models.GeoCodeProvider{Name: "tomtom"}, true},
+		{"provider not in the plan", userAccess{uId: "a", plan: pro, hasPlan: true}, models.GeoCodeProvider{Name: "here"}, false},
+		{"denied user", userAccess{uId: "a"}, models.GeoCodeProvider{DeniedUsers: []string{"a"}}, false},
+		{"denied plan", userAccess{uId: "a", plan: free, hasPlan: true}, models.GeoCodeProvider{DeniedPlans: []string{"free"}}, false},
+		{"allowed user", userAccess{uId: "a"}, models.GeoCodeProvider{AllowedUsers: []string{"a"}}, true},
+		{"allowed plan", userAccess{uId: "a", plan: free, hasPlan: true}, models.GeoCodeProvider{AllowedPlans: []string{"free"}}, true},
+		{"not allowed", userAccess{uId: "b", plan: free, hasPlan: true}, models.GeoCodeProvider{AllowedUsers: []string{"a"}, AllowedPlans: []string{"pro"}}, false},
+	}
+	for _, tt := range tests {
+		name := tt.prov.Name
+		if name == "" {
+			name = "tomtom"
+		}
+		if got := tt.access.allows(name, &tt.prov); got != tt.allows {
+			t.Errorf("%s : allows = %v, want %v", tt.name, got, tt.allows)
+		}
+	}
+}
+
+func TestPlanChargedOnlyIfProviderReached(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	now := time.Date(2016, 3, 30, 12, 0, 0, 0, time.UTC)
+	g := newPlansGeocoder(t, &now)
+	err := g.SetProviders([]*models.GeoCodeProvider{{Name: "tomtom", TypeName: "tomtom", Uri: srv.URL, IntervalSizeInDays: 1, BreakerThreshold: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider was asked, so its request counts even though it failed
+	if _, err = g.Reverse(context.Background(), 50.9, 13.3, RequestOptions{UserId: "a"}); err != ErrNoRequestsLeft {
+		t.Fatalf("lookup with failing provider : %v, want %v", err, ErrNoRequestsLeft)
+	}
+	if u := g.PlanUsage("a"); u.DayCount != 1 {
+		t.Errorf("usage after failed provider = %+v, want 1 request", u)
+	}
+
+	// the provider is skipped while it is paused, so nothing is charged
+	g.allProviders[0].Lock()
+	g.allProviders[0].prov.NextAllowedRequestTime = now.Add(time.Hour).UnixNano()
+	g.allProviders[0].Unlock()
+	if _, err = g.Reverse(context.Background(), 50.8, 13.3, RequestOptions{UserId: "a"}); err != ErrNoRequestsLeft {
+		t.Fatalf("lookup with paused provider : %v, want %v", err, ErrNoRequestsLeft)
+	}
+	if u := g.PlanUsage("a"); u.DayCount != 1 {
+		t.Errorf("usage after skipped provider = %+v, want 1 request", u)
+	}
+}
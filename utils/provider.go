@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"sync"
+	"time"
+)
+
+// Query holds everything a provider needs to know to build a single geocoding request.
+type Query struct {
+	Lat     float64 // only used for reverse requests
+	Lng     float64 // only used for reverse requests
+	Address string  // only used for forward requests
+	UserId  string
+	Time    time.Time // when the request is sent, according to the clock of the Geocoder
+
+	Country    string             // ISO 3166 country code to restrict forward lookups to, optional
+	Focus      *BatchPoint        // prefer forward results close to this point, optional
+	Structured *StructuredAddress // the parts of Address, if it was given in parts
+
+	sent bool // a request for the query was sent to a provider, so it used up a request of the plan of the user
+}
+
+// StructuredAddress is an address given in parts, for providers with a structured search.
+type StructuredAddress struct {
+	Street      string
+	HouseNumber string
+	Postal      string
+	City        string
+	Country     string
+}
+
+// String returns the address joined for providers without a structured search.
+func (a StructuredAddress) String() string {
+	return JoinAddress(a.Street, a.HouseNumber, a.Postal, a.City, a.Country)
+}
+
+// Provider is implemented by every geocoding backend. Implementations register themselves with RegisterProviderType,
+// usually from an init function in their own file, and are selected by GeoCodeProvider.TypeName (or the legacy
+// numeric GeoCodeProvider.Type).
+type Provider interface {
+	// ReverseUri returns the uri to request for a reverse lookup of q.Lat/q.Lng.
+	ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error)
+	// ForwardUri returns the uri to request for a forward lookup of q.Address.
+	ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error)
+	// ParseReverse fills addr from the body of a reverse response. Returns ErrEmptyResult if nothing was found.
+	// log is the Logger of the Geocoder.
+	ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error
+	// ParseForward fills addr from the body of a forward response. Returns ErrEmptyResult if nothing was found.
+	ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error
+	// UpdateQuota updates the request counters of provider from the body of a response.
+	UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger)
+	// IsChain returns true if the provider is another odl-geocoder, which already asked all its own providers and
+	// keeps track of the requests per user itself.
+	IsChain() bool
+}
+
+// RequestSpacer is implemented by providers whose usage policy demands a minimum time between requests - it is used
+// instead of GeoCodeProvider.TimeBetweenRequests if that is shorter.
+type RequestSpacer interface {
+	MinTimeBetweenRequests(provider *models.GeoCodeProvider) time.Duration
+}
+
+// RequestCounter is implemented by providers that do not report back their usage - CountRequest is called with the
+// lock of the provider held as soon as a request was sent, whatever the response is, so failed requests that use up
+// the contingent are counted as well.
+type RequestCounter interface {
+	CountRequest(provider *models.GeoCodeProvider, q *Query)
+}
+
+// CachePolicy is implemented by providers whose terms do not allow to store all results - results of providers without
+// it are always cached. body is the response the result was parsed from, so it can be decided per result.
+type CachePolicy interface {
+	Cacheable(body []byte, provider *models.GeoCodeProvider) bool
+}
+
+// defaultUserAgent is sent to providers without a GeoCodeProvider.UserAgent.
+const defaultUserAgent = "odl-geocoder (https://github.com/OpenDriversLog/odl-geocoder)"
+
+// countRequest counts a request for providers that do not report back their usage - the interval is the day since the
+// first request, or the calendar month for IntervalMonthly providers.
+func countRequest(provider *models.GeoCodeProvider, q *Query) {
+	end := provider.FirstIntervalRequest + 60*60*24*1000*1000*1000
+	if provider.IntervalMonthly {
+		end = intervalEnd(provider)
+	}
+	if end < q.Time.UnixNano() {
+		provider.CurIntervalRequests = 0
+		provider.UsersToReqCount = make(map[string]int)
+		provider.FirstIntervalRequest = q.Time.UnixNano()
+	}
+	provider.CurIntervalRequests++
+}
+
+// moreComplete tells if a is more complete than b, in the order geocode.farm results are compared : city, postal code,
+// street & house number. The first result wins among equally complete ones.
+func moreComplete(a *models.Address, b *models.Address) bool {
+	if b.City == "" && a.City != "" {
+		return true
+	} else if b.Postal == "" && a.Postal != "" && a.City != "" {
+		return true
+	} else if b.Street == "" && a.Street != "" && a.Postal != "" && a.City != "" {
+		return true
+	} else if b.HouseNumber == "" && a.HouseNumber != "" && a.Street != "" && a.Postal != "" && a.City != "" {
+		return true
+	}
+	return false
+}
+
+// legacyTypeNames maps the numeric GeoCodeProvider.Type used in older Providers.json files to the registered type names.
+var legacyTypeNames = map[int64]string{
+	1: "geocodefarm",
+	2: "chain",
+	3: "tomtom",
+	4: "opencage",
+}
+
+var providerTypesMu sync.RWMutex
+var providerTypes = make(map[string]Provider)
+
+// RegisterProviderType makes a provider implementation available under the given type name.
+// Registering the same name twice replaces the previous implementation.
+func RegisterProviderType(name string, p Provider) {
+	providerTypesMu.Lock()
+	providerTypes[name] = p
+	providerTypesMu.Unlock()
+}
+
+// ProviderTypeName returns the type name for the given provider, falling back to the legacy numeric type.
+func ProviderTypeName(provider *models.GeoCodeProvider) string {
+	if provider.TypeName != "" {
+		return provider.TypeName
+	}
+	return legacyTypeNames[provider.Type]
+}
+
+// GetProviderImpl returns the registered implementation for the given provider or ErrProviderNotSupported.
+func GetProviderImpl(provider *models.GeoCodeProvider) (p Provider, err error) {
+	providerTypesMu.RLock()
+	p = providerTypes[ProviderTypeName(provider)]
+	providerTypesMu.RUnlock()
+	if p == nil {
+		err = ErrProviderNotSupported
+	}
+	return
+}
+
+// IsChainProvider returns true if the given provider is a chained odl-geocoder.
+func IsChainProvider(provider *models.GeoCodeProvider) bool {
+	p, err := GetProviderImpl(provider)
+	return err == nil && p.IsChain()
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+)
+
+// ChainProvider forwards requests to another odl-geocoder, asking it not to chain any further. Key1 is the API key
+// (of type chain) the other odl-geocoder gave us.
+type ChainProvider struct{}
+
+func init() {
+	RegisterProviderType("chain", ChainProvider{})
+}
+
+func (ChainProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/reverse/%s/%s/blub/%f/%f?dontChain=1", url.PathEscape(q.UserId), chainKey(provider), q.Lat, q.Lng), nil
+}
+
+func (ChainProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	uri := provider.Uri + fmt.Sprintf("/forward/%s/%s/b/%s?dontChain=1", url.PathEscape(q.UserId), chainKey(provider), url.QueryEscape(q.Address))
+	if q.Country != "" {
+		uri += "&country=" + url.QueryEscape(q.Country)
+	}
+	if q.Focus != nil {
+		uri += fmt.Sprintf("&focus=%f,%f", q.Focus.Lat, q.Focus.Lng)
+	}
+	return uri, nil
+}
+
+// chainKey returns the key to send to the chained odl-geocoder - a dummy one, if it does not check keys.
+func chainKey(provider *models.GeoCodeProvider) string {
+	if provider.Key1 == "" {
+		return "b"
+	}
+	return url.PathEscape(provider.Key1)
+}
+
+func (ChainProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromChainResp(body, provider, addr, log)
+}
+
+func (ChainProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromChainResp(body, provider, addr, log)
+}
+
+// UpdateQuota takes over the limits the chained geocoder reports - it also keeps track of the requests per user.
+func (ChainProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+	var r models.GeoResp
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return
+	}
+	provider.MaxRequestsPerUserAndDay = r.MaxRequestsPerUser
+	provider.MaxRequestsPerInterval = r.MaxRequestsPerDay
+	provider.CurIntervalRequests = r.CurDailyRequestsUsed
+	if provider.UsersToReqCount == nil {
+		provider.UsersToReqCount = make(map[string]int)
+	}
+	provider.UsersToReqCount[q.UserId] = r.CurUserRequestsUsed
+}
+
+func (ChainProvider) IsChain() bool {
+	return true
+}
+
+// Cacheable passes on NoCache of the chained geocoder, e.g. for results of temporary mapbox geocoding.
+func (ChainProvider) Cacheable(body []byte, provider *models.GeoCodeProvider) bool {
+	var r models.GeoResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return true
+	}
+	return !r.NoCache
+}
+
+func FillAddrFromChainResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.GeoResp
+	err = json.Unmarshal(resp, &r)
+	if err != nil {
+		log.E(TAG, "Error processing Chain Resp : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	*addr = r.Address
+	return
+}
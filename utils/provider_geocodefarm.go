@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strconv"
+)
+
+// GeoCodeFarmProvider talks to the geocode.farm v3 json api.
+type GeoCodeFarmProvider struct{}
+
+func init() {
+	RegisterProviderType("geocodefarm", GeoCodeFarmProvider{})
+}
+
+func (GeoCodeFarmProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/reverse/?lat=%f&lon=%f&lang=en", q.Lat, q.Lng), nil
+}
+
+func (GeoCodeFarmProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/forward/?addr=%s&lang=en=1", url.QueryEscape(q.Address)), nil
+}
+
+func (GeoCodeFarmProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromGeoFarmResp(body, provider, addr, log)
+}
+
+func (GeoCodeFarmProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromGeoFarmResp(body, provider, addr, log)
+}
+
+// UpdateQuota reads the usage limit & the requests used today from the account section geocode.farm returns.
+func (GeoCodeFarmProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+	res := models.GeoCodeFarmResp{}
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		return
+	}
+	acc := res.GeocodingResults.Account
+	if acc.UsageLimit == "" {
+		log.W(TAG, "No Account in GeoCodeFarmResponse?")
+		return
+	}
+	ul, err := strconv.ParseInt(acc.UsageLimit, 10, 64)
+	if err != nil {
+		log.W(TAG, "Could not parse usage limit : ", acc.UsageLimit, err)
+		return
+	}
+	provider.MaxRequestsPerInterval = int(ul)
+	us, err := strconv.ParseInt(acc.UsedToday, 10, 64)
+	if err != nil {
+		log.W(TAG, "Could not parse used today : ", acc.UsedToday, err)
+		return
+	}
+	provider.CurIntervalRequests = int(us)
+}
+
+func (GeoCodeFarmProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromGeoFarmResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.GeoCodeFarmResult
+	res := models.GeoCodeFarmResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing GeoCodeFarmResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res.GeocodingResults, string(resp))
+	}
+	if len(res.GeocodingResults.Results) > 0 {
+		if len(res.GeocodingResults.Results) == 1 {
+			r = res.GeocodingResults.Results[0]
+		} else {
+			for _, v := range res.GeocodingResults.Results {
+				if r.FormattedAddress == "" {
+					r = v
+				} else if r.Address.Locality == "" && v.Address.Locality != "" {
+					r = v
+				} else if r.Address.Postal == "" && v.Address.Postal != "" && v.Address.Locality != "" {
+					r = v
+				} else if r.Address.StreetName == "" && v.Address.StreetName != "" && v.Address.Postal != "" && v.Address.Locality != "" {
+					r = v
+				} else if r.Address.StreetNumber == "" && v.Address.StreetNumber != "" && v.Address.StreetName != "" && v.Address.Postal != "" && v.Address.Locality != "" {
+					r = v
+				}
+				if r.Address.StreetNumber != "" {
+					break
+				}
+			}
+		}
+	}
+	err = nil
+
+	if r.FormattedAddress != "" {
+
+		a := r.Address
+		addr.HouseNumber = a.StreetNumber
+		addr.City = a.Locality
+		addr.Street = a.StreetName
+		addr.Postal = a.Postal
+		addr.Lat, _ = strconv.ParseFloat(r.Coordinates.Latitude, 64)
+		addr.Lng, _ = strconv.ParseFloat(r.Coordinates.Longitude, 64)
+		addr.Country = a.Country
+		addr.Title = r.FormattedAddress
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, a)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+
+}
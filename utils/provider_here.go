@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+)
+
+// HereProvider talks to the HERE Geocoding & Search api v7, Key1 is the apiKey. As forward & reverse lookups have
+// their own hosts, Uri is only needed to use another server (e.g. a proxy) for both - it gets /geocode & /revgeocode
+// appended. The freemium contingent is per month, so set IntervalMonthly.
+type HereProvider struct{}
+
+const (
+	hereGeocodeUri    = "https://geocode.search.hereapi.com/v1/geocode"
+	hereRevGeocodeUri = "https://revgeocode.search.hereapi.com/v1/revgeocode"
+)
+
+func init() {
+	RegisterProviderType("here", HereProvider{})
+}
+
+func (HereProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	uri := hereRevGeocodeUri
+	if provider.Uri != "" {
+		uri = provider.Uri + "/revgeocode"
+	}
+	return uri + fmt.Sprintf("?at=%f,%f&limit=5&apiKey=%s", q.Lat, q.Lng, url.QueryEscape(provider.Key1)), nil
+}
+
+func (HereProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	uri := hereGeocodeUri
+	if provider.Uri != "" {
+		uri = provider.Uri + "/geocode"
+	}
+	return uri + fmt.Sprintf("?q=%s&limit=5&apiKey=%s", url.QueryEscape(q.Address), url.QueryEscape(provider.Key1)), nil
+}
+
+func (HereProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromHereResp(body, provider, addr, log)
+}
+
+func (HereProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromHereResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (HereProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves, as HERE does not report back the usage of the month.
+func (HereProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (HereProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromHereResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.HereItem
+	res := models.HereResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing HereResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	found := false
+	for _, v := range res.Items {
+		if !found {
+			r, found = v, true
+		} else if a, b := hereAddress(&v), hereAddress(&r); moreComplete(&a, &b) {
+			r = v
+		}
+		if r.Address.HouseNumber != "" {
+			break
+		}
+	}
+	err = nil
+
+	if found {
+		*addr = hereAddress(&r)
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+// hereAddress maps an item - Accuracy is the queryScore of HERE (0 - 1), only set for forward lookups.
+func hereAddress(r *models.HereItem) (b models.Address) {
+	a := r.Address
+	b.HouseNumber = a.HouseNumber
+	b.Street = a.Street
+	b.City = a.City
+	b.Postal = a.PostalCode
+	b.Country = countryAlpha2(a.CountryCode)
+	b.Title = a.Label
+	if b.Title == "" {
+		b.Title = r.Title
+	}
+	b.Lat = r.Position.Lat
+	b.Lng = r.Position.Lng
+	if r.Scoring.QueryScore > 0 {
+		b.Accuracy = fmt.Sprintf("%.2f", r.Scoring.QueryScore)
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestHereUris(t *testing.T) {
+	tests := []struct {
+		name    string
+		prov    models.GeoCodeProvider
+		q       Query
+		reverse bool
+		want    string
+	}{
+		{"reverse", models.GeoCodeProvider{Key1: "a&b"}, Query{Lat: 50.91095, Lng: 13.32335}, true,
+			"https://revgeocode.search.hereapi.com/v1/revgeocode?at=50.910950,13.323350&limit=5&apiKey=a%26b"},
+		{"forward", models.GeoCodeProvider{Key1: "key"}, Query{Address: "Walterstal 101, Freiberg"}, false,
+			"https://geocode.search.hereapi.com/v1/geocode?q=Walterstal+101%2C+Freiberg&limit=5&apiKey=key"},
+		{"reverse via proxy", models.GeoCodeProvider{Uri: "http://proxy.local", Key1: "key"}, Query{Lat: 1, Lng: 2}, true,
+			"http://proxy.local/revgeocode?at=1.000000,2.000000&limit=5&apiKey=key"},
+		{"forward via proxy", models.GeoCodeProvider{Uri: "http://proxy.local", Key1: "key"}, Query{Address: "Freiberg"}, false,
+			"http://proxy.local/geocode?q=Freiberg&limit=5&apiKey=key"},
+	}
+	for _, tt := range tests {
+		var uri string
+		if tt.reverse {
+			uri, _ = HereProvider{}.ReverseUri(&tt.prov, &tt.q)
+		} else {
+			uri, _ = HereProvider{}.ForwardUri(&tt.prov, &tt.q)
+		}
+		if uri != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, uri, tt.want)
+		}
+	}
+}
+
+func TestHereAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		item models.HereItem
+		want models.Address
+	}{
+		{"house number", models.HereItem{
+			Title:    "Walterstal 101",
+			Address:  models.HereAddress{Label: "Walterstal 101, 09599 Freiberg, Deutschland", CountryCode: "DEU", City: "Freiberg", Street: "Walterstal", PostalCode: "09599", HouseNumber: "101"},
+			Position: models.HerePosition{Lat: 50.9, Lng: 13.3},
+			Scoring:  models.HereScoring{QueryScore: 0.95}},
+			models.Address{HouseNumber: "101", Street: "Walterstal", City: "Freiberg", Postal: "09599", Country: "DE", Title: "Walterstal 101, 09599 Freiberg, Deutschland", Lat: 50.9, Lng: 13.3, Accuracy: "0.95"}},
+		{"no label, no scoring", models.HereItem{Title: "Freiberg", Address: models.HereAddress{City: "Freiberg"}},
+			models.Address{City: "Freiberg", Title: "Freiberg"}},
+	}
+	for _, tt := range tests {
+		if got := hereAddress(&tt.item); got != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromHereResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string // title of the chosen item
+		err  error
+	}{
+		{"single item", `{"items":[{"title":"Freiberg","address":{"city":"Freiberg"}}]}`, "Freiberg", nil},
+		{"most complete item", `{"items":[
+			{"title":"Freiberg","address":{"city":"Freiberg"}},
+			{"title":"Walterstal 101","address":{"city":"Freiberg","postalCode":"09599","street":"Walterstal","houseNumber":"101"}},
+			{"title":"Walterstal 102","address":{"city":"Freiberg","postalCode":"09599","street":"Walterstal","houseNumber":"102"}}]}`,
+			"Walterstal 101", nil},
+		{"no items", `{"items":[]}`, "", ErrEmptyResult},
+		{"error response", `{"status":401,"title":"Unauthorized"}`, "", ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromHereResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && addr.Title != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, addr.Title, tt.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MapboxProvider talks to the Mapbox Geocoding api v5, Key1 is the access token. Uri is only needed to use another
+// server (e.g. a proxy), it defaults to https://api.mapbox.com. The options forwardTypes & reverseTypes are passed as
+// types filter, e.g. reverseTypes "address" to only get addresses for coordinates.
+// Results of the mapbox.places endpoint may not be stored according to the terms of Mapbox, so they are not cached -
+// set the option permanent to "true" to use mapbox.places-permanent instead, whose results may be cached.
+type MapboxProvider struct{}
+
+const mapboxUri = "https://api.mapbox.com"
+
+// options of mapbox providers in GeoCodeProvider.Options
+const (
+	mapboxForwardTypes = "forwardTypes"
+	mapboxReverseTypes = "reverseTypes"
+	mapboxPermanent    = "permanent"
+)
+
+func init() {
+	RegisterProviderType("mapbox", MapboxProvider{})
+}
+
+func (MapboxProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	types := provider.Options[mapboxReverseTypes]
+	v := mapboxParams(provider, types)
+	if types != "" && !strings.Contains(types, ",") {
+		// reverse lookups only allow more than one result for a single type
+		v.Set("limit", "5")
+	}
+	query := strconv.FormatFloat(q.Lng, 'f', 6, 64) + "," + strconv.FormatFloat(q.Lat, 'f', 6, 64)
+	return mapboxEndpoint(provider) + "/" + query + ".json?" + v.Encode(), nil
+}
+
+func (MapboxProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	v := mapboxParams(provider, provider.Options[mapboxForwardTypes])
+	v.Set("limit", "5")
+	if q.Country != "" {
+		v.Set("country", strings.ToLower(q.Country))
+	}
+	if q.Focus != nil {
+		v.Set("proximity", strconv.FormatFloat(q.Focus.Lng, 'f', 6, 64)+","+strconv.FormatFloat(q.Focus.Lat, 'f', 6, 64))
+	}
+	// the query is part of the path - mapbox does not allow semicolons in it
+	query := strings.Replace(q.Address, ";", ",", -1)
+	return mapboxEndpoint(provider) + "/" + url.PathEscape(query) + ".json?" + v.Encode(), nil
+}
+
+func mapboxEndpoint(provider *models.GeoCodeProvider) string {
+	uri := mapboxUri
+	if provider.Uri != "" {
+		uri = provider.Uri
+	}
+	if mapboxIsPermanent(provider) {
+		return uri + "/geocoding/v5/mapbox.places-permanent"
+	}
+	return uri + "/geocoding/v5/mapbox.places"
+}
+
+func mapboxIsPermanent(provider *models.GeoCodeProvider) bool {
+	permanent, _ := strconv.ParseBool(provider.Options[mapboxPermanent])
+	return permanent
+}
+
+func mapboxParams(provider *models.GeoCodeProvider, types string) url.Values {
+	v := url.Values{}
+	v.Set("access_token", provider.Key1)
+	setIfNotEmpty(v, "types", types)
+	return v
+}
+
+func (MapboxProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromMapboxResp(body, provider, addr, log)
+}
+
+func (MapboxProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromMapboxResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (MapboxProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves, as Mapbox only reports its per minute limit in the X-Rate-Limit headers.
+func (MapboxProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (MapboxProvider) IsChain() bool {
+	return false
+}
+
+// Cacheable only allows to cache results of the permanent endpoint.
+func (MapboxProvider) Cacheable(body []byte, provider *models.GeoCodeProvider) bool {
+	return mapboxIsPermanent(provider)
+}
+
+func FillAddrFromMapboxResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.MapboxFeature
+	res := models.MapboxResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing MapboxResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	found := false
+	for _, v := range res.Features {
+		if !found {
+			r, found = v, true
+		} else if a, b := mapboxAddress(&v), mapboxAddress(&r); moreComplete(&a, &b) {
+			r = v
+		}
+		if r.Address != "" {
+			break
+		}
+	}
+	err = nil
+
+	if found {
+		*addr = mapboxAddress(&r)
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+// mapboxAddress maps a feature - postal code, city, region & country come from its context, unless the feature is one
+// of them itself. Additional1 is the place type (e.g. address or poi), Additional2 the region & Accuracy the relevance
+// of Mapbox (0 - 1).
+func mapboxAddress(f *models.MapboxFeature) (b models.Address) {
+	parts := append([]models.MapboxContext{{Id: f.Id, Text: f.Text, ShortCode: f.Properties.ShortCode}}, f.Context...)
+	for _, c := range parts {
+		switch c.Id[:strings.Index(c.Id+".", ".")] {
+		case "address", "street":
+			if b.Street == "" {
+				b.Street = c.Text
+			}
+		case "poi":
+			if f.Properties.Address != "" {
+				// the street of a poi is only known as text, e.g. "Walterstal 101"
+				b.Street = f.Properties.Address
+			}
+		case "postcode":
+			b.Postal = c.Text
+		case "place":
+			b.City = c.Text
+		case "region":
+			b.Additional2 = c.Text
+		case "country":
+			b.Country = strings.ToUpper(c.ShortCode)
+		}
+	}
+	b.HouseNumber = f.Address
+	b.Title = f.PlaceName
+	if len(f.PlaceType) > 0 {
+		b.Additional1 = f.PlaceType[0]
+	}
+	if len(f.Center) == 2 {
+		b.Lng = f.Center[0]
+		b.Lat = f.Center[1]
+	}
+	if f.Relevance > 0 {
+		b.Accuracy = fmt.Sprintf("%.2f", f.Relevance)
+	}
+	return
+}
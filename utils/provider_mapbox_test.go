@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestMapboxUris(t *testing.T) {
+	tests := []struct {
+		name    string
+		prov    models.GeoCodeProvider
+		q       Query
+		reverse bool
+		want    string
+	}{
+		{"reverse", models.GeoCodeProvider{Key1: "tok"}, Query{Lat: 50.91095, Lng: 13.32335}, true,
+			"https://api.mapbox.com/geocoding/v5/mapbox.places/13.323350,50.910950.json?access_token=tok"},
+		{"reverse of a single type", models.GeoCodeProvider{Key1: "tok", Options: map[string]string{"reverseTypes": "address"}}, Query{Lat: 1, Lng: 2}, true,
+			"https://api.mapbox.com/geocoding/v5/mapbox.places/2.000000,1.000000.json?access_token=tok&limit=5&types=address"},
+		{"reverse of several types", models.GeoCodeProvider{Key1: "tok", Options: map[string]string{"reverseTypes": "address,poi"}}, Query{Lat: 1, Lng: 2}, true,
+			"https://api.mapbox.com/geocoding/v5/mapbox.places/2.000000,1.000000.json?access_token=tok&types=address%2Cpoi"},
+		{"permanent via proxy", models.GeoCodeProvider{Uri: "http://proxy.local", Key1: "tok", Options: map[string]string{"permanent": "true"}}, Query{Lat: 1, Lng: 2}, true,
+			"http://proxy.local/geocoding/v5/mapbox.places-permanent/2.000000,1.000000.json?access_token=tok"},
+		{"forward", models.GeoCodeProvider{Key1: "tok", Options: map[string]string{"forwardTypes": "address"}}, Query{Address: "Walterstal 101; Freiberg"}, false,
+			"https://api.mapbox.com/geocoding/v5/mapbox.places/Walterstal%20101%2C%20Freiberg.json?access_token=tok&limit=5&types=address"},
+		{"forward with country & focus", models.GeoCodeProvider{Key1: "tok"}, Query{Address: "Freiberg", Country: "DE", Focus: &BatchPoint{Lat: 50.9, Lng: 13.3}}, false,
+			"https://api.mapbox.com/geocoding/v5/mapbox.places/Freiberg.json?access_token=tok&country=de&limit=5&proximity=13.300000%2C50.900000"},
+	}
+	for _, tt := range tests {
+		var uri string
+		if tt.reverse {
+			uri, _ = MapboxProvider{}.ReverseUri(&tt.prov, &tt.q)
+		} else {
+			uri, _ = MapboxProvider{}.ForwardUri(&tt.prov, &tt.q)
+		}
+		if uri != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, uri, tt.want)
+		}
+	}
+}
+
+func TestMapboxCacheable(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		want    bool
+	}{
+		{nil, false},
+		{map[string]string{"permanent": "false"}, false},
+		{map[string]string{"permanent": "yes"}, false},
+		{map[string]string{"permanent": "true"}, true},
+		{map[string]string{"permanent": "1"}, true},
+	}
+	for _, tt := range tests {
+		if got := (MapboxProvider{}).Cacheable(nil, &models.GeoCodeProvider{Options: tt.options}); got != tt.want {
+			t.Errorf("Cacheable with options %v = %v, want %v", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestMapboxAddress(t *testing.T) {
+	parts := []models.MapboxContext{
+		{Id: "postcode.1", Text: "09599"},
+		{Id: "place.2", Text: "Freiberg"},
+		{Id: "region.3", Text: "Sachsen", ShortCode: "DE-SN"},
+		{Id: "country.4", Text: "Deutschland", ShortCode: "de"},
+	}
+	tests := []struct {
+		name string
+		f    models.MapboxFeature
+		want models.Address
+	}{
+		{"address", models.MapboxFeature{Id: "address.9", PlaceType: []string{"address"}, Relevance: 1, Address: "101", Text: "Walterstal",
+			PlaceName: "Walterstal 101, 09599 Freiberg, Deutschland", Center: []float64{13.3, 50.9}, Context: parts},
+			models.Address{HouseNumber: "101", Street: "Walterstal", Postal: "09599", City: "Freiberg", Country: "DE", Title: "Walterstal 101, 09599 Freiberg, Deutschland",
+				Additional1: "address", Additional2: "Sachsen", Lat: 50.9, Lng: 13.3, Accuracy: "1.00"}},
+		{"poi", models.MapboxFeature{Id: "poi.9", PlaceType: []string{"poi"}, Text: "Aral", Properties: models.MapboxProperties{Address: "Chemnitzer Str. 1"}, Context: parts[:2]},
+			models.Address{Street: "Chemnitzer Str. 1", Postal: "09599", City: "Freiberg", Additional1: "poi"}},
+		{"place", models.MapboxFeature{Id: "place.2", PlaceType: []string{"place"}, Text: "Freiberg", Context: parts[2:]},
+			models.Address{City: "Freiberg", Country: "DE", Additional1: "place", Additional2: "Sachsen"}},
+		{"country", models.MapboxFeature{Id: "country.4", Text: "Deutschland", Properties: models.MapboxProperties{ShortCode: "de"}},
+			models.Address{Country: "DE"}},
+	}
+	for _, tt := range tests {
+		if got := mapboxAddress(&tt.f); got != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromMapboxResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string // place name of the chosen feature
+		err  error
+	}{
+		{"address first", `{"features":[
+			{"id":"address.1","place_name":"Walterstal 101","address":"101","text":"Walterstal","context":[{"id":"place.2","text":"Freiberg"}]},
+			{"id":"place.2","place_name":"Freiberg","text":"Freiberg"}]}`,
+			"Walterstal 101", nil},
+		{"most complete feature", `{"features":[
+			{"id":"place.2","place_name":"Freiberg","text":"Freiberg"},
+			{"id":"address.1","place_name":"Walterstal","text":"Walterstal","context":[{"id":"postcode.1","text":"09599"},{"id":"place.2","text":"Freiberg"}]}]}`,
+			"Walterstal", nil},
+		{"no features", `{"features":[]}`, "", ErrEmptyResult},
+		{"error response", `{"message":"Not Authorized - Invalid Token"}`, "", ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromMapboxResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && addr.Title != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, addr.Title, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NominatimProvider talks to a Nominatim instance, Uri is its base uri (e.g. https://nominatim.openstreetmap.org).
+// Email is sent along if set, as the usage policy of the public instance asks for it, just like an identifying
+// User-Agent (GeoCodeProvider.UserAgent).
+type NominatimProvider struct{}
+
+// nominatimPublicHost is the instance of the OpenStreetMap Foundation, which allows at most one request per second.
+const nominatimPublicHost = "nominatim.openstreetmap.org"
+
+func init() {
+	RegisterProviderType("nominatim", NominatimProvider{})
+}
+
+func (NominatimProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/reverse?format=jsonv2&addressdetails=1&lat=%f&lon=%f", q.Lat, q.Lng) + nominatimEmail(provider), nil
+}
+
+func (NominatimProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/search?format=jsonv2&addressdetails=1&limit=5&q=%s", url.QueryEscape(q.Address)) + nominatimEmail(provider), nil
+}
+
+func nominatimEmail(provider *models.GeoCodeProvider) string {
+	if provider.Email == "" {
+		return ""
+	}
+	return "&email=" + url.QueryEscape(provider.Email)
+}
+
+func (NominatimProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromNominatimReverseResp(body, provider, addr, log)
+}
+
+func (NominatimProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromNominatimSearchResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (NominatimProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves, as Nominatim does not report back any usage.
+func (NominatimProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (NominatimProvider) IsChain() bool {
+	return false
+}
+
+// MinTimeBetweenRequests makes sure we send at most one request per second to the public instance - self hosted ones
+// only use TimeBetweenRequests.
+func (NominatimProvider) MinTimeBetweenRequests(provider *models.GeoCodeProvider) time.Duration {
+	u, err := url.Parse(provider.Uri)
+	if err == nil && strings.EqualFold(u.Hostname(), nominatimPublicHost) {
+		return time.Second
+	}
+	return 0
+}
+
+func FillAddrFromNominatimReverseResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.NominatimResult
+	err = json.Unmarshal(resp, &r)
+	if err != nil {
+		log.E(TAG, "Error processing NominatimReverseResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", r, string(resp))
+	}
+	err = nil
+
+	if r.DisplayName != "" && len(r.Error) == 0 {
+		FillAddrFromNominatimResult(&r, addr)
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+func FillAddrFromNominatimSearchResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.NominatimResult
+	var res []models.NominatimResult
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing NominatimSearchResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	if len(res) > 0 {
+		if len(res) == 1 {
+			r = res[0]
+		} else {
+			for _, v := range res {
+				if CompareNominatimAddress(&v, &r) {
+					r = v
+				}
+				if r.Address.HouseNumber != "" {
+					break
+				}
+			}
+		}
+	}
+	err = nil
+
+	if r.DisplayName != "" {
+		FillAddrFromNominatimResult(&r, addr)
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+func FillAddrFromNominatimResult(r *models.NominatimResult, b *models.Address) {
+	a := r.Address
+	b.HouseNumber = a.HouseNumber
+	b.Street = nominatimStreet(&a)
+	b.City = nominatimCity(&a)
+	b.Postal = a.Postcode
+	b.Country = strings.ToUpper(a.CountryCode)
+	b.Title = r.DisplayName
+	b.Lat, _ = strconv.ParseFloat(r.Lat, 64)
+	b.Lng, _ = strconv.ParseFloat(r.Lon, 64)
+}
+
+func nominatimStreet(a *models.NominatimAddress) string {
+	if a.Road != "" {
+		return a.Road
+	} else if a.Pedestrian != "" {
+		return a.Pedestrian
+	}
+	return a.Footway
+}
+
+func nominatimCity(a *models.NominatimAddress) string {
+	if a.City != "" {
+		return a.City
+	} else if a.Town != "" {
+		return a.Town
+	} else if a.Village != "" {
+		return a.Village
+	} else if a.Municipality != "" {
+		return a.Municipality
+	}
+	return a.Hamlet
+}
+
+// returns true if a is more complete than b - the first result wins among equally complete ones, as they are sorted
+// by relevance
+func CompareNominatimAddress(a *models.NominatimResult, b *models.NominatimResult) bool {
+	aStreet, bStreet := nominatimStreet(&a.Address), nominatimStreet(&b.Address)
+	aCity, bCity := nominatimCity(&a.Address), nominatimCity(&b.Address)
+	if b.DisplayName == "" {
+		return a.DisplayName != ""
+	} else if bCity == "" {
+		return aCity != ""
+	} else if b.Address.Postcode == "" {
+		return a.Address.Postcode != "" && aCity != ""
+	} else if bStreet == "" {
+		return aStreet != "" && a.Address.Postcode != "" && aCity != ""
+	} else if b.Address.HouseNumber == "" {
+		return a.Address.HouseNumber != "" && aStreet != "" && a.Address.Postcode != "" && aCity != ""
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestNominatimUris(t *testing.T) {
+	prov := &models.GeoCodeProvider{Uri: "http://osm.local", Email: "a+b@c.de"}
+	uri, _ := NominatimProvider{}.ReverseUri(prov, &Query{Lat: 50.91095, Lng: 13.32335})
+	if want := "http://osm.local/reverse?format=jsonv2&addressdetails=1&lat=50.910950&lon=13.323350&email=a%2Bb%40c.de"; uri != want {
+		t.Errorf("ReverseUri = %s, want %s", uri, want)
+	}
+	uri, _ = NominatimProvider{}.ForwardUri(&models.GeoCodeProvider{Uri: "http://osm.local"}, &Query{Address: "Walterstal 101, Freiberg"})
+	if want := "http://osm.local/search?format=jsonv2&addressdetails=1&limit=5&q=Walterstal+101%2C+Freiberg"; uri != want {
+		t.Errorf("ForwardUri = %s, want %s", uri, want)
+	}
+}
+
+func TestNominatimMinTimeBetweenRequests(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want time.Duration
+	}{
+		{"https://nominatim.openstreetmap.org", time.Second},
+		{"https://Nominatim.OpenStreetMap.org:443/", time.Second},
+		{"http://localhost:8080", 0},
+	}
+	for _, tt := range tests {
+		if got := (NominatimProvider{}).MinTimeBetweenRequests(&models.GeoCodeProvider{Uri: tt.uri}); got != tt.want {
+			t.Errorf("MinTimeBetweenRequests(%s) = %v, want %v", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromNominatimReverseResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want models.Address
+		err  error
+	}{
+		{"town", `{"lat":"50.9","lon":"13.3","display_name":"Walterstal 101, Freiberg","address":{"house_number":"101","road":"Walterstal","town":"Freiberg","postcode":"09599","country_code":"de"}}`,
+			models.Address{Street: "Walterstal", HouseNumber: "101", City: "Freiberg", Postal: "09599", Country: "DE", Title: "Walterstal 101, Freiberg", Lat: 50.9, Lng: 13.3}, nil},
+		{"pedestrian & village", `{"lat":"1","lon":"2","display_name":"Markt, X","address":{"pedestrian":"Markt","village":"X","country_code":"de"}}`,
+			models.Address{Street: "Markt", City: "X", Country: "DE", Title: "Markt, X", Lat: 1, Lng: 2}, nil},
+		{"error", `{"error":"Unable to geocode"}`, models.Address{}, ErrEmptyResult},
+		{"invalid json", `<html>`, models.Address{}, ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromNominatimReverseResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && addr != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, addr, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromNominatimSearchResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string // display name of the chosen result
+		err  error
+	}{
+		{"single result", `[{"display_name":"Freiberg","address":{"town":"Freiberg"}}]`, "Freiberg", nil},
+		{"most complete result", `[{"display_name":"Freiberg","address":{"town":"Freiberg"}},{"display_name":"Walterstal","address":{"road":"Walterstal","town":"Freiberg","postcode":"09599"}},{"display_name":"Walterstal 2","address":{"road":"Walterstal","house_number":"2","town":"Freiberg","postcode":"09599"}}]`, "Walterstal 2", nil},
+		{"first of equally complete results", `[{"display_name":"A","address":{"town":"A","postcode":"1"}},{"display_name":"B","address":{"town":"B","postcode":"2"}}]`, "A", nil},
+		{"no result", `[]`, "", ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromNominatimSearchResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && addr.Title != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, addr.Title, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OpenCageProvider talks to the OpenCage geocoder, Key1 is the api key. As the same endpoint is used for forward and
+// reverse lookups, Uri already contains the query string (e.g. ...geocode/v1/json?min_confidence=10).
+type OpenCageProvider struct{}
+
+// replace Walterstal 101 09599 Freiberg with Walterstal 101, 09599 Freiberg
+var OpenCageRegExp = regexp.MustCompile("([0-9][A-Z]?)\\ ([0-9]{4,5})\\ (\\w)")
+
+func init() {
+	RegisterProviderType("opencage", OpenCageProvider{})
+}
+
+func (OpenCageProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("&q=%f,%f&key=%s", q.Lat, q.Lng, provider.Key1), nil
+}
+
+func (OpenCageProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	// replace Walterstal 101 09599 Freiberg with Walterstal 101, 09599 Freiberg
+	s := OpenCageRegExp.ReplaceAllString(q.Address, "$1, $2 $3")
+	return provider.Uri + fmt.Sprintf("&q=%s&key=%s", url.QueryEscape(s), provider.Key1), nil
+}
+
+func (OpenCageProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromOpenCageResp(body, provider, addr, log)
+}
+
+func (OpenCageProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromOpenCageResp(body, provider, addr, log)
+}
+
+// UpdateQuota takes over the rate limits OpenCage reports with every response.
+func (OpenCageProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+	res := models.OpenCageResponse{}
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		return
+	}
+	provider.FirstIntervalRequest = int64(res.Rate.Reset)*1000*1000*1000 - 60*60*24*1000*1000*1000 // 24 hours before interval reset = first request
+	provider.CurIntervalRequests = res.Rate.Limit - res.Rate.Remaining
+	provider.MaxRequestsPerInterval = res.Rate.Limit
+}
+
+func (OpenCageProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromOpenCageAddress(r *models.OpenCageResult, b *models.Address) {
+	a := r.Components
+	b.HouseNumber = a.HouseNumber
+	if a.City != "" {
+		b.City = a.City
+	} else {
+		b.City = a.Town
+	}
+	if a.Road == "" {
+		b.Street = a.Footway
+	} else {
+		b.Street = a.Road
+	}
+	// Chemnitzer Straße, Dampfbahn-Route Sachsen
+	commaIdx := strings.Index(string(b.Street), ",")
+	if commaIdx > 0 {
+		b.Street = string(b.Street)[0:commaIdx]
+	}
+	b.Postal = a.PostCode
+	b.Country = a.Country
+	b.Title = r.Formatted
+	b.Lat = r.Geometry.Lat
+	b.Lng = r.Geometry.Lng
+	b.Accuracy = fmt.Sprintf("%d", r.Confidence)
+	b.Fuel = a.Fuel
+}
+
+func FillAddrFromOpenCageResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.OpenCageResult
+	res := models.OpenCageResponse{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing OpenCageResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	if len(res.Results) > 0 {
+		if len(res.Results) == 1 {
+			r = res.Results[0]
+		} else {
+			for _, v := range res.Results {
+				if r.Formatted == "" && v.Formatted != "" {
+					r = v
+				} else if r.Components.Town == "" && r.Components.City == "" && (v.Components.Town != "" || v.Components.City != "") {
+					r = v
+				} else if r.Components.PostCode == "" && v.Components.PostCode != "" && (v.Components.Town != "" || v.Components.City != "") {
+					r = v
+				} else if r.Components.Road == "" && r.Components.Footway == "" && (v.Components.Road != "" || v.Components.Footway != "") &&
+					v.Components.PostCode != "" && (v.Components.Town != "" || v.Components.City != "") {
+					r = v
+				} else if r.Components.HouseNumber == "" && v.Components.HouseNumber != "" &&
+					(v.Components.Road != "" || v.Components.Footway != "") &&
+					v.Components.PostCode != "" && (v.Components.Town != "" || v.Components.City != "") {
+					r = v
+				} else if r.Components.Fuel == "" && v.Components.Fuel != "" &&
+					v.Components.HouseNumber != "" && (v.Components.Road != "" || v.Components.Footway != "") &&
+					v.Components.PostCode != "" && (v.Components.Town != "" || v.Components.City != "") {
+					r = v
+				}
+				if r.Components.HouseNumber != "" && r.Components.Fuel != "" && (r.Components.Road != "" || r.Components.Footway != "") {
+					break
+				}
+			}
+		}
+	}
+
+	if r.Formatted != "" {
+		FillAddrFromOpenCageAddress(&r, addr)
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Components)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+
+}
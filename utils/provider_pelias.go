@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PeliasProvider talks to a Pelias instance, Uri is its base uri without /v1. Key1 is sent as api_key, if the instance
+// needs one. Addresses given in parts use the structured search, the country & focus point of the request are passed
+// on as boundary.country & focus.point.
+type PeliasProvider struct{}
+
+func init() {
+	RegisterProviderType("pelias", PeliasProvider{})
+}
+
+func (PeliasProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	v := peliasParams(provider)
+	v.Set("point.lat", strconv.FormatFloat(q.Lat, 'f', 6, 64))
+	v.Set("point.lon", strconv.FormatFloat(q.Lng, 'f', 6, 64))
+	return provider.Uri + "/v1/reverse?" + v.Encode(), nil
+}
+
+func (PeliasProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	v := peliasParams(provider)
+	if q.Country != "" {
+		v.Set("boundary.country", q.Country)
+	}
+	if q.Focus != nil {
+		v.Set("focus.point.lat", strconv.FormatFloat(q.Focus.Lat, 'f', 6, 64))
+		v.Set("focus.point.lon", strconv.FormatFloat(q.Focus.Lng, 'f', 6, 64))
+	}
+	if a := q.Structured; a != nil {
+		setIfNotEmpty(v, "address", strings.TrimSpace(a.Street+" "+a.HouseNumber))
+		setIfNotEmpty(v, "postalcode", a.Postal)
+		setIfNotEmpty(v, "locality", a.City)
+		setIfNotEmpty(v, "country", a.Country)
+		return provider.Uri + "/v1/search/structured?" + v.Encode(), nil
+	}
+	v.Set("text", q.Address)
+	return provider.Uri + "/v1/search?" + v.Encode(), nil
+}
+
+func peliasParams(provider *models.GeoCodeProvider) url.Values {
+	v := url.Values{}
+	v.Set("size", "5")
+	setIfNotEmpty(v, "api_key", provider.Key1)
+	return v
+}
+
+func setIfNotEmpty(v url.Values, key string, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
+
+func (PeliasProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromPeliasResp(body, provider, addr, log)
+}
+
+func (PeliasProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromPeliasResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (PeliasProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves - hosted instances report their limits in the X-RateLimit headers, which
+// are read for every provider.
+func (PeliasProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (PeliasProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromPeliasResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.PeliasFeature
+	res := models.PeliasResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing PeliasResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	found := false
+	for _, v := range res.Features {
+		if len(v.Geometry.Coordinates) < 2 {
+			continue
+		}
+		if !found {
+			r, found = v, true
+		} else if a, b := peliasAddress(&v.Properties), peliasAddress(&r.Properties); moreComplete(&a, &b) {
+			r = v
+		}
+		if r.Properties.HouseNumber != "" {
+			break
+		}
+	}
+	err = nil
+
+	if found {
+		*addr = peliasAddress(&r.Properties)
+		addr.Lng = r.Geometry.Coordinates[0]
+		addr.Lat = r.Geometry.Coordinates[1]
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+// peliasAddress maps the properties of a feature. Accuracy is the confidence of Pelias (0 - 1), Additional1 its layer.
+func peliasAddress(p *models.PeliasProperties) (b models.Address) {
+	b.HouseNumber = p.HouseNumber
+	b.Street = p.Street
+	if b.Street == "" && p.Layer == "street" {
+		b.Street = p.Name
+	}
+	b.City = p.Locality
+	if b.City == "" {
+		b.City = p.LocalAdmin
+	}
+	b.Postal = p.PostalCode
+	b.Country = countryAlpha2(p.CountryCode)
+	if b.Country == "" {
+		b.Country = countryAlpha2(p.CountryA)
+	}
+	b.Title = p.Label
+	if p.Confidence > 0 {
+		b.Accuracy = fmt.Sprintf("%.2f", p.Confidence)
+	}
+	b.Additional1 = p.Layer
+	return
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestPeliasUris(t *testing.T) {
+	withKey := &models.GeoCodeProvider{Uri: "http://pelias.local", Key1: "secret"}
+	noKey := &models.GeoCodeProvider{Uri: "http://pelias.local"}
+	tests := []struct {
+		name    string
+		prov    *models.GeoCodeProvider
+		q       Query
+		reverse bool
+		want    string
+	}{
+		{"reverse", withKey, Query{Lat: 50.91095, Lng: 13.32335}, true,
+			"http://pelias.local/v1/reverse?api_key=secret&point.lat=50.910950&point.lon=13.323350&size=5"},
+		{"search", noKey, Query{Address: "Walterstal 101, Freiberg"}, false,
+			"http://pelias.local/v1/search?size=5&text=Walterstal+101%2C+Freiberg"},
+		{"search with country & focus", noKey, Query{Address: "Walterstal", Country: "DE", Focus: &BatchPoint{Lat: 50.9, Lng: 13.3}}, false,
+			"http://pelias.local/v1/search?boundary.country=DE&focus.point.lat=50.900000&focus.point.lon=13.300000&size=5&text=Walterstal"},
+		{"structured search", noKey, Query{Address: "Walterstal 101, 09599 Freiberg", Structured: &StructuredAddress{Street: "Walterstal", HouseNumber: "101", Postal: "09599", City: "Freiberg"}}, false,
+			"http://pelias.local/v1/search/structured?address=Walterstal+101&locality=Freiberg&postalcode=09599&size=5"},
+		{"structured search without street", noKey, Query{Address: "Freiberg, DE", Structured: &StructuredAddress{City: "Freiberg", Country: "DE"}}, false,
+			"http://pelias.local/v1/search/structured?country=DE&locality=Freiberg&size=5"},
+	}
+	for _, tt := range tests {
+		var uri string
+		if tt.reverse {
+			uri, _ = PeliasProvider{}.ReverseUri(tt.prov, &tt.q)
+		} else {
+			uri, _ = PeliasProvider{}.ForwardUri(tt.prov, &tt.q)
+		}
+		if uri != tt.want {
+			t.Errorf("%s : got %s, want %s", tt.name, uri, tt.want)
+		}
+	}
+}
+
+func TestPeliasAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		p    models.PeliasProperties
+		want models.Address
+	}{
+		{"address", models.PeliasProperties{Layer: "address", HouseNumber: "101", Street: "Walterstal", PostalCode: "09599", Locality: "Freiberg", CountryA: "DEU", CountryCode: "de", Confidence: 0.9, Label: "Walterstal 101, Freiberg, Germany"},
+			models.Address{HouseNumber: "101", Street: "Walterstal", Postal: "09599", City: "Freiberg", Country: "DE", Accuracy: "0.90", Additional1: "address", Title: "Walterstal 101, Freiberg, Germany"}},
+		{"street", models.PeliasProperties{Layer: "street", Name: "Walterstal", LocalAdmin: "Freiberg", CountryA: "DEU"},
+			models.Address{Street: "Walterstal", City: "Freiberg", Country: "DE", Additional1: "street"}},
+		{"venue", models.PeliasProperties{Layer: "venue", Name: "Aral", Locality: "Freiberg"},
+			models.Address{City: "Freiberg", Additional1: "venue"}},
+	}
+	for _, tt := range tests {
+		if got := peliasAddress(&tt.p); got != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromPeliasResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string // label of the chosen feature
+		err  error
+	}{
+		{"most complete feature", `{"features":[
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"layer":"locality","locality":"Freiberg","label":"Freiberg"}},
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"layer":"address","street":"Walterstal","housenumber":"101","postalcode":"09599","locality":"Freiberg","label":"Walterstal 101"}}]}`,
+			"Walterstal 101", nil},
+		{"feature without coordinates skipped", `{"features":[
+			{"geometry":{},"properties":{"street":"Walterstal","housenumber":"101","label":"Walterstal 101"}},
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"locality":"Freiberg","label":"Freiberg"}}]}`,
+			"Freiberg", nil},
+		{"no features", `{"features":[]}`, "", ErrEmptyResult},
+		{"invalid json", `Bad Gateway`, "", ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromPeliasResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && (addr.Title != tt.want || addr.Lat != 50.9 || addr.Lng != 13.3) {
+			t.Errorf("%s : got %+v, want %s at 50.9,13.3", tt.name, addr, tt.want)
+		}
+	}
+}
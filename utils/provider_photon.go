@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strings"
+)
+
+// PhotonProvider talks to a Photon instance (e.g. https://photon.komoot.io), Uri is its base uri. Photon tolerates
+// typos, so it suits addresses entered by hand.
+type PhotonProvider struct{}
+
+func init() {
+	RegisterProviderType("photon", PhotonProvider{})
+}
+
+func (PhotonProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/reverse?lat=%f&lon=%f&limit=5", q.Lat, q.Lng), nil
+}
+
+func (PhotonProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/api?q=%s&limit=5", url.QueryEscape(q.Address)), nil
+}
+
+func (PhotonProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromPhotonResp(body, provider, addr, log)
+}
+
+func (PhotonProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromPhotonResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (PhotonProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves, as Photon does not report back any usage.
+func (PhotonProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (PhotonProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromPhotonResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.PhotonFeature
+	res := models.PhotonResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing PhotonResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	found := false
+	for _, v := range res.Features {
+		if len(v.Geometry.Coordinates) < 2 {
+			continue
+		}
+		if !found {
+			r, found = v, true
+		} else if a, b := photonAddress(&v.Properties), photonAddress(&r.Properties); moreComplete(&a, &b) {
+			r = v
+		}
+		if r.Properties.HouseNumber != "" {
+			break
+		}
+	}
+	err = nil
+
+	if found {
+		*addr = photonAddress(&r.Properties)
+		addr.Lng = r.Geometry.Coordinates[0]
+		addr.Lat = r.Geometry.Coordinates[1]
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v", addr, r)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+}
+
+// photonAddress maps the properties of a feature - for streets & places the name is the street or city itself.
+// Additional1 is the kind of the feature as osm_key=osm_value, e.g. amenity=fuel.
+func photonAddress(p *models.PhotonProperties) (b models.Address) {
+	b.HouseNumber = p.HouseNumber
+	b.Street = p.Street
+	if b.Street == "" && p.OsmKey == "highway" {
+		b.Street = p.Name
+	}
+	b.City = p.City
+	if b.City == "" && p.OsmKey == "place" && (p.OsmValue == "city" || p.OsmValue == "town" || p.OsmValue == "village") {
+		b.City = p.Name
+	}
+	if b.City == "" {
+		b.City = p.Locality
+	}
+	b.Postal = p.Postcode
+	b.Country = strings.ToUpper(p.CountryCode)
+	if b.Country == "" {
+		b.Country = p.Country
+	}
+	if p.OsmKey != "" {
+		b.Additional1 = p.OsmKey + "=" + p.OsmValue
+	}
+	if p.OsmKey == "amenity" && p.OsmValue == "fuel" {
+		b.Fuel = p.Name
+	}
+	b.Title = JoinAddress(b.Street, b.HouseNumber, b.Postal, b.City, p.Country)
+	if b.Title == "" {
+		b.Title = p.Name
+	} else if p.Name != "" && p.Name != b.Street && p.Name != b.City {
+		b.Title = p.Name + ", " + b.Title
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestPhotonUris(t *testing.T) {
+	prov := &models.GeoCodeProvider{Uri: "http://photon.local"}
+	uri, _ := PhotonProvider{}.ReverseUri(prov, &Query{Lat: 50.91095, Lng: 13.32335})
+	if want := "http://photon.local/reverse?lat=50.910950&lon=13.323350&limit=5"; uri != want {
+		t.Errorf("ReverseUri = %s, want %s", uri, want)
+	}
+	uri, _ = PhotonProvider{}.ForwardUri(prov, &Query{Address: "Walterstal 101, Freiberg"})
+	if want := "http://photon.local/api?q=Walterstal+101%2C+Freiberg&limit=5"; uri != want {
+		t.Errorf("ForwardUri = %s, want %s", uri, want)
+	}
+}
+
+func TestPhotonAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		p    models.PhotonProperties
+		want models.Address
+	}{
+		{"house", models.PhotonProperties{OsmKey: "building", OsmValue: "yes", HouseNumber: "101", Street: "Walterstal", Postcode: "09599", City: "Freiberg", Country: "Deutschland", CountryCode: "de"},
+			models.Address{HouseNumber: "101", Street: "Walterstal", Postal: "09599", City: "Freiberg", Country: "DE", Additional1: "building=yes", Title: "Walterstal 101, 09599 Freiberg, Deutschland"}},
+		{"street", models.PhotonProperties{OsmKey: "highway", OsmValue: "residential", Name: "Walterstal", City: "Freiberg"},
+			models.Address{Street: "Walterstal", City: "Freiberg", Additional1: "highway=residential", Title: "Walterstal, Freiberg"}},
+		{"town", models.PhotonProperties{OsmKey: "place", OsmValue: "town", Name: "Freiberg", Country: "Deutschland"},
+			models.Address{City: "Freiberg", Country: "Deutschland", Additional1: "place=town", Title: "Freiberg, Deutschland"}},
+		{"locality", models.PhotonProperties{Locality: "Zug", Street: "Hauptstr."},
+			models.Address{City: "Zug", Street: "Hauptstr.", Title: "Hauptstr., Zug"}},
+		{"fuel station", models.PhotonProperties{OsmKey: "amenity", OsmValue: "fuel", Name: "Aral", Street: "Chemnitzer Str.", City: "Freiberg"},
+			models.Address{Street: "Chemnitzer Str.", City: "Freiberg", Additional1: "amenity=fuel", Fuel: "Aral", Title: "Aral, Chemnitzer Str., Freiberg"}},
+		{"name only", models.PhotonProperties{Name: "Nowhere"}, models.Address{Title: "Nowhere"}},
+	}
+	for _, tt := range tests {
+		if got := photonAddress(&tt.p); got != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillAddrFromPhotonResp(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string // title of the chosen feature
+		err  error
+	}{
+		{"most complete feature", `{"features":[
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"osm_key":"place","osm_value":"town","name":"Freiberg"}},
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"street":"Walterstal","housenumber":"101","postcode":"09599","city":"Freiberg"}}]}`,
+			"Walterstal 101, 09599 Freiberg", nil},
+		{"feature without coordinates skipped", `{"features":[
+			{"geometry":{},"properties":{"street":"Walterstal","housenumber":"101","city":"Freiberg"}},
+			{"geometry":{"coordinates":[13.3,50.9]},"properties":{"city":"Freiberg"}}]}`,
+			"Freiberg", nil},
+		{"no features", `{"features":[]}`, "", ErrEmptyResult},
+	}
+	for _, tt := range tests {
+		var addr models.Address
+		err := FillAddrFromPhotonResp([]byte(tt.resp), &models.GeoCodeProvider{}, &addr, dbgLogger{})
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && (addr.Title != tt.want || addr.Lat != 50.9 || addr.Lng != 13.3) {
+			t.Errorf("%s : got %+v, want %s at 50.9,13.3", tt.name, addr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TomTomProvider talks to the TomTom search api v2, Key1 is the api key.
+type TomTomProvider struct{}
+
+func init() {
+	RegisterProviderType("tomtom", TomTomProvider{})
+}
+
+func (TomTomProvider) ReverseUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/reverseGeocode/%f,%f.JSON?key=%s", q.Lat, q.Lng, provider.Key1), nil
+}
+
+func (TomTomProvider) ForwardUri(provider *models.GeoCodeProvider, q *Query) (string, error) {
+	return provider.Uri + fmt.Sprintf("/geocode/%s.JSON?key=%s", url.QueryEscape(q.Address), provider.Key1), nil
+}
+
+func (TomTomProvider) ParseReverse(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromTomTomReverseResp(body, provider, addr, log)
+}
+
+func (TomTomProvider) ParseForward(body []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) error {
+	return FillAddrFromTomTomForwardResp(body, provider, addr, log)
+}
+
+// UpdateQuota does nothing, our own count is kept by CountRequest.
+func (TomTomProvider) UpdateQuota(body []byte, provider *models.GeoCodeProvider, q *Query, log Logger) {
+}
+
+// CountRequest counts the requests ourselves, as TomTom does not report back the current daily count.
+func (TomTomProvider) CountRequest(provider *models.GeoCodeProvider, q *Query) {
+	countRequest(provider, q)
+}
+
+func (TomTomProvider) IsChain() bool {
+	return false
+}
+
+func FillAddrFromTomTomForwardResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var r models.TomTomForwardResult
+	res := models.TomTomForwardResp{}
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing TomTomForwardResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	if len(res.Results) > 0 {
+		if len(res.Results) == 1 {
+			r = res.Results[0]
+		} else {
+			for _, v := range res.Results {
+				if CompareTomTomAddress(&v.Address, &r.Address) {
+					r = v
+				}
+				if r.Address.StreetNumber != "" || r.Address.BuildingNumber != "" {
+					break
+				}
+			}
+		}
+	}
+
+	if r.Address.FreeFormAddress != "" {
+		FillAddrFromTomTomAddress(&r.Address, addr)
+		addr.Lat = r.Position.Lat
+		addr.Lng = r.Position.Lon
+
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Address)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+
+}
+
+func FillAddrFromTomTomReverseResp(resp []byte, provider *models.GeoCodeProvider, addr *models.Address, log Logger) (err error) {
+	if addr == nil {
+		log.E(TAG, "Error : Got nil address to fil")
+		return errors.New("Address object is nil.")
+	}
+
+	var res models.TomTomReverseResp
+	var r models.TomTomReverseResult
+	err = json.Unmarshal(resp, &res)
+	if err != nil {
+		log.E(TAG, "Error processing TomTomReverseResponse : ", err)
+		if Debug {
+			log.I(TAG, "Response : ", string(resp))
+		}
+	}
+	if Debug {
+		log.I(TAG, "Parsed result : %+v \r\n from resp %s", res, string(resp))
+	}
+	if len(res.Addresses) > 0 {
+		if len(res.Addresses) == 1 {
+			r = res.Addresses[0]
+		} else {
+			for _, v := range res.Addresses {
+				if CompareTomTomAddress(&v.Address, &r.Address) {
+					r = v
+				}
+				if r.Address.StreetNumber != "" || r.Address.BuildingNumber != "" {
+					break
+				}
+			}
+		}
+	}
+
+	if r.Address.FreeFormAddress != "" {
+		FillAddrFromTomTomAddress(&r.Address, addr)
+		splitted := strings.Split(r.Position, ",")
+		if len(splitted) == 2 {
+			addr.Lat, _ = strconv.ParseFloat(splitted[0], 64)
+			addr.Lng, _ = strconv.ParseFloat(splitted[1], 64)
+		}
+
+		if Debug {
+			log.I(TAG, "Got address \r\n %+v \r\n out of result \r\n %+v \r\n with address \r\n %+v", addr, r, r.Address)
+		}
+		return
+	} else {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+
+}
+
+func FillAddrFromTomTomAddress(a *models.TomTomAddress, b *models.Address) {
+	if a.StreetNumber != "" {
+		b.HouseNumber = a.StreetNumber
+	} else {
+		b.HouseNumber = a.BuildingNumber
+	}
+	b.City = a.Municipality
+	if a.Street != "" {
+		b.Street = a.Street
+	} else {
+		b.Street = a.StreetName
+	}
+	// Chemnitzer Straße, Dampfbahn-Route Sachsen
+	commaIdx := strings.Index(string(b.Street), ",")
+	if commaIdx > 0 {
+		b.Street = string(b.Street)[0:commaIdx]
+	}
+	b.Postal = a.PostalCode
+	b.Country = a.CountryCode
+	b.Title = a.FreeFormAddress
+}
+
+// returns true if a is better then b
+func CompareTomTomAddress(a *models.TomTomAddress, b *models.TomTomAddress) bool {
+	if a.FreeFormAddress == "" && b.FreeFormAddress != "" {
+		return false
+	} else if a.Municipality == "" && b.Municipality != "" {
+		return false
+	} else if a.PostalCode == "" && b.PostalCode != "" && b.Municipality != "" {
+		return false
+	} else if a.StreetName == "" && a.Street == "" &&
+		(b.StreetName != "" || b.Street != "") &&
+		b.PostalCode != "" && b.Municipality != "" {
+		return false
+	} else if a.StreetNumber == "" && a.BuildingNumber == "" && (b.StreetNumber != "" || b.BuildingNumber != "") &&
+		(b.StreetName != "" || b.Street != "") &&
+		b.PostalCode != "" && b.Municipality != "" {
+		return false
+	}
+	return true
+}
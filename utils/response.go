@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"errors"
+	"github.com/OpenDriversLog/odl-geocoder/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRateLimited = errors.New("Provider rate limit reached")
+
+// StatusError is returned for responses of a provider with an http status we can not use, e.g. 500 or 400.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "Provider returned http status " + e.Status
+}
+
+const (
+	// rateLimitPause is how long a provider is skipped after 429 Too Many Requests without a Retry-After header
+	rateLimitPause = time.Minute
+	// quotaPause is how long a provider is skipped after 402 Payment Required (quota used up) without a Retry-After header
+	quotaPause = 10 * time.Minute
+)
+
+// rateLimitHeaders are the headers providers announce their remaining requests & the time they are reset with - e.g.
+// X-RateLimit-* of opencage or X-Rate-Limit-* of mapbox. The reset is either a unix timestamp or the seconds until the
+// reset.
+var rateLimitHeaders = []struct {
+	remaining string
+	reset     string
+}{
+	{"X-RateLimit-Remaining", "X-RateLimit-Reset"},
+	{"X-Rate-Limit-Remaining", "X-Rate-Limit-Reset"},
+	{"RateLimit-Remaining", "RateLimit-Reset"},
+}
+
+// checkResponse classifies the http status of a provider response & sets NextAllowedRequestTime from Retry-After or the
+// rate limit headers. It returns nil for 2xx, ErrNeedFixBeforeRetry if the provider rejected our credentials,
+// ErrRateLimited for 429 & 402 and a *StatusError otherwise. The caller needs to hold the lock of the provider.
+func (g *Geocoder) checkResponse(resp *http.Response, body []byte, provider *models.GeoCodeProvider, now time.Time) (err error) {
+	code := resp.StatusCode
+	switch {
+	case code >= 200 && code < 300:
+		if next, ok := rateLimitReset(resp.Header, now, false); ok {
+			g.log.I(TAG, "Provider %s has no requests left until %v", provider.Name, next)
+			pauseUntil(provider, next)
+		}
+		return
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		g.log.E(TAG, "Provider %s rejected our credentials (%s) - please check its key in Providers.json", provider.Name, resp.Status)
+		err = ErrNeedFixBeforeRetry
+	case code == http.StatusTooManyRequests || code == http.StatusPaymentRequired:
+		next, ok := retryAfter(resp.Header, now)
+		if !ok {
+			next, ok = rateLimitReset(resp.Header, now, true)
+		}
+		if !ok {
+			next = now.Add(rateLimitPause)
+			if code == http.StatusPaymentRequired {
+				next = now.Add(quotaPause)
+			}
+		}
+		g.log.W(TAG, "Provider %s is rate limited (%s) until %v", provider.Name, resp.Status, next)
+		pauseUntil(provider, next)
+		err = ErrRateLimited
+	default:
+		if next, ok := retryAfter(resp.Header, now); ok {
+			pauseUntil(provider, next)
+		}
+		err = &StatusError{StatusCode: code, Status: resp.Status}
+	}
+	if Debug {
+		g.log.I(TAG, "Response : ", string(body))
+	}
+	return
+}
+
+// pauseUntil makes sure the provider is not asked before t.
+func pauseUntil(provider *models.GeoCodeProvider, t time.Time) {
+	if t.UnixNano() > provider.NextAllowedRequestTime {
+		provider.NextAllowedRequestTime = t.UnixNano()
+	}
+}
+
+// retryAfter parses the Retry-After header - either seconds or an http date.
+func retryAfter(h http.Header, now time.Time) (t time.Time, ok bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return
+		}
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// rateLimitReset returns when the requests of the provider are reset, if the rate limit headers tell it has none left.
+// If we already know that from the status (limited), the remaining header is not needed - mapbox does not send one.
+func rateLimitReset(h http.Header, now time.Time, limited bool) (t time.Time, ok bool) {
+	for _, v := range rateLimitHeaders {
+		remaining, err := strconv.ParseInt(strings.TrimSpace(h.Get(v.remaining)), 10, 64)
+		if !limited && (err != nil || remaining > 0) {
+			continue
+		}
+		reset, err := strconv.ParseInt(strings.TrimSpace(h.Get(v.reset)), 10, 64)
+		if err != nil || reset < 0 {
+			continue
+		}
+		if reset > 1000*1000*1000 { // unix timestamp
+			t = time.Unix(reset, 0)
+		} else {
+			t = now.Add(time.Duration(reset) * time.Second)
+		}
+		return t, true
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OpenDriversLog/odl-geocoder/models"
+)
+
+func TestCheckResponse(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		code     int
+		header   map[string]string
+		err      error // nil, ErrNeedFixBeforeRetry, ErrRateLimited or errStatus for a *StatusError
+		pausedTo time.Time
+	}{
+		{"ok", 200, nil, nil, time.Time{}},
+		{"ok, requests left", 200, map[string]string{"X-RateLimit-Remaining": "5", "X-RateLimit-Reset": "60"}, nil, time.Time{}},
+		{"ok, last request", 200, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1700003600"}, nil, now.Add(time.Hour)},
+		{"bad key", 401, nil, ErrNeedFixBeforeRetry, time.Time{}},
+		{"forbidden", 403, nil, ErrNeedFixBeforeRetry, time.Time{}},
+		{"too many requests", 429, nil, ErrRateLimited, now.Add(rateLimitPause)},
+		{"quota used up", 402, nil, ErrRateLimited, now.Add(quotaPause)},
+		{"retry after seconds", 429, map[string]string{"Retry-After": "120"}, ErrRateLimited, now.Add(2 * time.Minute)},
+		{"retry after date", 429, map[string]string{"Retry-After": now.Add(time.Hour).UTC().Format(http.TimeFormat)}, ErrRateLimited, now.Add(time.Hour)},
+		{"mapbox reset", 429, map[string]string{"X-Rate-Limit-Reset": "1700000030"}, ErrRateLimited, now.Add(30 * time.Second)},
+		{"server error", 500, nil, errStatus, time.Time{}},
+		{"unavailable with retry after", 503, map[string]string{"Retry-After": "10"}, errStatus, now.Add(10 * time.Second)},
+	}
+	g, _ := NewGeocoder(Options{})
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.code, Status: http.StatusText(tt.code), Header: http.Header{}}
+		for k, v := range tt.header {
+			resp.Header.Set(k, v)
+		}
+		prov := &models.GeoCodeProvider{Name: "test"}
+		err := g.checkResponse(resp, nil, prov, now)
+		if se, ok := err.(*StatusError); ok && se.StatusCode == tt.code {
+			err = errStatus
+		}
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+		}
+		var paused time.Time
+		if prov.NextAllowedRequestTime != 0 {
+			paused = time.Unix(0, prov.NextAllowedRequestTime)
+		}
+		if !paused.Equal(tt.pausedTo) {
+			t.Errorf("%s : paused until %v, want %v", tt.name, paused, tt.pausedTo)
+		}
+	}
+}
+
+// errStatus stands for any *StatusError in TestCheckResponse.
+var errStatus = &StatusError{}
+
+func TestPauseUntilKeepsLaterPause(t *testing.T) {
+	later := time.Unix(1700000600, 0)
+	prov := &models.GeoCodeProvider{NextAllowedRequestTime: later.UnixNano()}
+	pauseUntil(prov, later.Add(-time.Minute))
+	if prov.NextAllowedRequestTime != later.UnixNano() {
+		t.Errorf("pause shortened to %v", time.Unix(0, prov.NextAllowedRequestTime))
+	}
+}
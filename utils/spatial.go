@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"container/list"
+	"math"
+	"sync"
+)
+
+// spatialCell identifies a cell of the grid used by SpatialIndex.
+type spatialCell struct {
+	y int64
+	x int64
+}
+
+type spatialPoint struct {
+	key  string
+	lat  float64
+	lng  float64
+	cell spatialCell
+}
+
+// SpatialIndex finds the cached reverse lookup closest to a position. Points are kept in grid cells of cellSize metres,
+// so only the 9 cells around a position need to be checked for any radius up to cellSize. It is safe for concurrent use.
+type SpatialIndex struct {
+	mu        sync.RWMutex
+	cellSize  float64
+	maxPoints int
+	cells     map[spatialCell]map[string]*list.Element
+	points    map[string]*list.Element
+	order     *list.List // oldest inserted first, values are *spatialPoint
+}
+
+// NewSpatialIndex creates an index with the given cell size in metres, holding at most maxPoints points (0 = no limit).
+func NewSpatialIndex(cellSize float64, maxPoints int) *SpatialIndex {
+	if cellSize < 1 {
+		cellSize = 1
+	}
+	return &SpatialIndex{
+		cellSize:  cellSize,
+		maxPoints: maxPoints,
+		cells:     make(map[spatialCell]map[string]*list.Element),
+		points:    make(map[string]*list.Element),
+		order:     list.New(),
+	}
+}
+
+func (s *SpatialIndex) latStep() float64 {
+	return s.cellSize / metresPerDegree
+}
+
+// lngStep returns the width of the cells in the given row in degrees - cells get wider towards the poles.
+func (s *SpatialIndex) lngStep(y int64) float64 {
+	rowLat := (float64(y) + 0.5) * s.latStep()
+	return s.cellSize / (metresPerDegree * math.Max(math.Cos(rowLat*math.Pi/180), 0.01))
+}
+
+func (s *SpatialIndex) cellFor(lat float64, lng float64) spatialCell {
+	y := int64(math.Floor(lat / s.latStep()))
+	return spatialCell{y: y, x: int64(math.Floor(lng / s.lngStep(y)))}
+}
+
+// Insert adds or moves the point stored for key.
+func (s *SpatialIndex) Insert(key string, lat float64, lng float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el := s.points[key]; el != nil {
+		s.removeElement(el)
+	}
+	p := &spatialPoint{key: key, lat: lat, lng: lng, cell: s.cellFor(lat, lng)}
+	el := s.order.PushBack(p)
+	s.points[key] = el
+	cell := s.cells[p.cell]
+	if cell == nil {
+		cell = make(map[string]*list.Element)
+		s.cells[p.cell] = cell
+	}
+	cell[key] = el
+	for s.maxPoints > 0 && s.order.Len() > s.maxPoints {
+		s.removeElement(s.order.Front())
+	}
+}
+
+// Remove removes the point stored for key, e.g. because it is not in the cache anymore.
+func (s *SpatialIndex) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el := s.points[key]; el != nil {
+		s.removeElement(el)
+	}
+}
+
+func (s *SpatialIndex) removeElement(el *list.Element) {
+	p := el.Value.(*spatialPoint)
+	s.order.Remove(el)
+	delete(s.points, p.key)
+	if cell := s.cells[p.cell]; cell != nil {
+		delete(cell, p.key)
+		if len(cell) == 0 {
+			delete(s.cells, p.cell)
+		}
+	}
+}
+
+// Nearest returns the key of the point closest to lat/lng and its distance in metres, if there is one within radius.
+// radius should not be bigger than the cell size.
+func (s *SpatialIndex) Nearest(lat float64, lng float64, radius float64) (key string, dist float64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	y := int64(math.Floor(lat / s.latStep()))
+	for dy := int64(-1); dy <= 1; dy++ {
+		x := int64(math.Floor(lng / s.lngStep(y+dy)))
+		for dx := int64(-1); dx <= 1; dx++ {
+			for _, el := range s.cells[spatialCell{y: y + dy, x: x + dx}] {
+				p := el.Value.(*spatialPoint)
+				d := Distance(lat, lng, p.lat, p.lng)
+				if d <= radius && (!ok || d < dist) {
+					key, dist, ok = p.key, d, true
+				}
+			}
+		}
+	}
+	return
+}
+
+// Distance returns the distance between two coordinates in metres (haversine formula).
+func Distance(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	const earthRadius = 6371000.0
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLng := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
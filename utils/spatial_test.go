@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		want                   float64
+	}{
+		{"same point", 50.91095, 13.32335, 50.91095, 13.32335, 0},
+		{"0.001 degree latitude", 50.91095, 13.32335, 50.91195, 13.32335, 111.2},
+		{"freiberg - dresden", 50.91095, 13.32335, 51.05089, 13.73832, 32960},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.lat1, tt.lng1, tt.lat2, tt.lng2); math.Abs(got-tt.want) > tt.want/100+0.1 {
+			t.Errorf("%s : Distance = %.1f, want %.1f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpatialIndexNearest(t *testing.T) {
+	s := NewSpatialIndex(100, 0)
+	s.Insert("a", 50.91095, 13.32335)
+	s.Insert("b", 50.91140, 13.32335) // 50m north of a
+	s.Insert("c", 50.91095, 13.32500) // 116m east of a
+	s.Insert("moved", 0, 0)
+	s.Insert("moved", 50.91095, 13.32400) // 46m east of a
+	s.Insert("removed", 50.91096, 13.32335)
+	s.Remove("removed")
+
+	tests := []struct {
+		name     string
+		lat, lng float64
+		radius   float64
+		key      string
+		found    bool
+	}{
+		{"exact position", 50.91095, 13.32335, 20, "a", true},
+		{"closest of two", 50.91125, 13.32335, 50, "b", true},
+		{"moved point", 50.91095, 13.32410, 20, "moved", true},
+		{"out of radius", 50.91095, 13.32600, 50, "", false},
+		{"empty area", 0, 0, 100, "", false},
+	}
+	for _, tt := range tests {
+		key, _, ok := s.Nearest(tt.lat, tt.lng, tt.radius)
+		if key != tt.key || ok != tt.found {
+			t.Errorf("%s : Nearest = %q, %v, want %q, %v", tt.name, key, ok, tt.key, tt.found)
+		}
+	}
+}
+
+func TestSpatialIndexMaxPoints(t *testing.T) {
+	s := NewSpatialIndex(100, 2)
+	s.Insert("a", 50.91095, 13.32335)
+	s.Insert("b", 50.91140, 13.32335)
+	s.Insert("c", 50.91185, 13.32335)
+	if key, _, ok := s.Nearest(50.91095, 13.32335, 10); ok {
+		t.Errorf("oldest point %s not dropped", key)
+	}
+	if key, _, ok := s.Nearest(50.91185, 13.32335, 10); !ok || key != "c" {
+		t.Errorf("Nearest = %q, %v, want c", key, ok)
+	}
+}
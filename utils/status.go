@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"strconv"
+	"time"
+)
+
+// ProviderStatus is the live state of a single provider.
+type ProviderStatus struct {
+	Name                     string
+	TypeName                 string
+	Disabled                 bool
+	SkipReason               string // why the provider is not asked right now - empty if it is available
+	CurIntervalRequests      int
+	MaxRequestsPerInterval   int
+	MaxRequestsPerUserAndDay int
+	IntervalSizeInDays       int
+	IntervalMonthly          bool
+	IntervalStart            time.Time
+	NextAllowedRequestTime   time.Time
+	LastRequestTime          time.Time
+	LastError                string
+	LastErrorTime            time.Time
+	LastLatencyMs            float64
+	Successes                int64  // requests that returned an address
+	Empty                    int64  // requests that returned no result
+	Errors                   int64  // failed requests
+	Skips                    int64  // times the provider was skipped, e.g. because its contingent was used up
+	BreakerState             string // closed, open or half-open - see BreakerClosed
+	ConsecutiveFailures      int    // failed requests in a row while the breaker is closed
+	BreakerOpenUntil         time.Time
+}
+
+// Status is the live state of all providers, with the aggregate request counts & the cache counters.
+type Status struct {
+	MaxRequestsPerDay    int
+	CurDailyRequestsUsed int
+	Providers            []ProviderStatus
+	Cache                CacheStats
+}
+
+// Status returns the live state of all providers.
+func (g *Geocoder) Status() (s Status) {
+	now := g.now()
+	g.providersMu.RLock()
+	for _, p := range g.allProviders {
+		p.Lock()
+		v := p.prov
+		ps := ProviderStatus{
+			Name:                     p.name,
+			TypeName:                 ProviderTypeName(v),
+			Disabled:                 v.Disabled,
+			SkipReason:               skipReason(p, now),
+			CurIntervalRequests:      v.CurIntervalRequests,
+			MaxRequestsPerInterval:   v.MaxRequestsPerInterval,
+			MaxRequestsPerUserAndDay: v.MaxRequestsPerUserAndDay,
+			IntervalSizeInDays:       v.IntervalSizeInDays,
+			IntervalMonthly:          v.IntervalMonthly,
+			IntervalStart:            unixNanoTime(v.FirstIntervalRequest),
+			NextAllowedRequestTime:   unixNanoTime(v.NextAllowedRequestTime),
+			LastRequestTime:          unixNanoTime(v.LastRequestTime),
+			LastError:                p.stats.lastError,
+			LastErrorTime:            p.stats.lastErrorTime,
+			LastLatencyMs:            float64(p.stats.lastLatency) / float64(time.Millisecond),
+			Successes:                p.stats.successes,
+			Empty:                    p.stats.empty,
+			Errors:                   p.stats.errors,
+			Skips:                    p.stats.skips,
+			BreakerState:             p.breaker.State(now),
+			ConsecutiveFailures:      p.breaker.failures,
+			BreakerOpenUntil:         p.breaker.openUntil,
+		}
+		if days := intervalDays(v); !v.Disabled && days != 0 {
+			s.MaxRequestsPerDay += v.MaxRequestsPerInterval / days
+			s.CurDailyRequestsUsed += v.CurIntervalRequests
+		}
+		p.Unlock()
+		s.Providers = append(s.Providers, ps)
+	}
+	g.providersMu.RUnlock()
+	s.Cache = g.CacheStats()
+	return
+}
+
+// skipReason tells why the provider would be skipped right now - the caller needs to hold its lock.
+func skipReason(p *providerState, now time.Time) string {
+	v := p.prov
+	if v.Disabled {
+		return "disabled"
+	}
+	if _, err := GetProviderImpl(v); err != nil {
+		if v.TypeName == "" {
+			return "unknown provider type " + strconv.FormatInt(v.Type, 10)
+		}
+		return "unknown provider type " + v.TypeName
+	}
+	rollover := intervalEnd(v)
+	if v.MaxRequestsPerInterval != 0 && v.MaxRequestsPerInterval-v.CurIntervalRequests <= 1 && rollover > now.UnixNano() {
+		return "contingent used up until " + time.Unix(0, rollover).Format(time.RFC3339)
+	}
+	if v.NextAllowedRequestTime > now.Add(time.Second).UnixNano() {
+		return "paused until " + time.Unix(0, v.NextAllowedRequestTime).Format(time.RFC3339)
+	}
+	if p.breaker.State(now) == BreakerOpen {
+		return "circuit open until " + p.breaker.openUntil.Format(time.RFC3339)
+	}
+	return ""
+}
+
+func unixNanoTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// TrackPoint is a single recorded position of a track.
+type TrackPoint struct {
+	Lat  float64
+	Lng  float64
+	Time time.Time
+}
+
+// StopOptions are the thresholds used to detect stops in a track.
+type StopOptions struct {
+	MinDwell      time.Duration // min time spent within MaxDistance to count as a stop, default 5 minutes
+	MaxDistance   float64       // max distance in metres from where the stop started, default 100
+	SkipEndpoints bool          // don't return the start & end of the track as stops, if they are no stops themselves
+}
+
+// Stop is a place a track stayed at - the position is the centre of all points of the stop.
+type Stop struct {
+	Lat       float64
+	Lng       float64
+	Arrival   time.Time
+	Departure time.Time
+	Result
+	Err error
+}
+
+// DetectStops returns the stops of a track - all places the track stayed within MaxDistance for at least MinDwell.
+// Unless SkipEndpoints is set, the start & end of the track are returned as stops as well.
+// The points are sorted by time first.
+func DetectStops(points []TrackPoint, opts StopOptions) (stops []Stop) {
+	if opts.MinDwell <= 0 {
+		opts.MinDwell = 5 * time.Minute
+	}
+	if opts.MaxDistance <= 0 {
+		opts.MaxDistance = 100
+	}
+	if len(points) == 0 {
+		return
+	}
+	points = append([]TrackPoint{}, points...)
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	for i := 0; i < len(points); {
+		// extend the stop as long as the points stay close to where it started
+		j := i
+		for j+1 < len(points) && Distance(points[i].Lat, points[i].Lng, points[j+1].Lat, points[j+1].Lng) <= opts.MaxDistance {
+			j++
+		}
+		isStop := points[j].Time.Sub(points[i].Time) >= opts.MinDwell
+		if isStop || (!opts.SkipEndpoints && (i == 0 || j == len(points)-1)) {
+			stops = append(stops, newStop(points[i:j+1]))
+		}
+		if isStop || j == len(points)-1 {
+			i = j + 1
+		} else {
+			i++
+		}
+	}
+	return
+}
+
+// newStop returns the stop covering all points.
+func newStop(points []TrackPoint) Stop {
+	s := Stop{Arrival: points[0].Time, Departure: points[len(points)-1].Time}
+	for _, p := range points {
+		s.Lat += p.Lat
+		s.Lng += p.Lng
+	}
+	s.Lat /= float64(len(points))
+	s.Lng /= float64(len(points))
+	return s
+}
+
+// ReverseTrack detects the stops of a track and reverse geocodes only them.
+func (g *Geocoder) ReverseTrack(ctx context.Context, points []TrackPoint, stopOpts StopOptions, opts RequestOptions) []Stop {
+	stops := DetectStops(points, stopOpts)
+	batch := make([]BatchPoint, len(stops))
+	for i, s := range stops {
+		batch[i] = BatchPoint{Lat: s.Lat, Lng: s.Lng}
+	}
+	for i, r := range g.ReverseBatch(ctx, batch, opts) {
+		stops[i].Result, stops[i].Err = r.Result, r.Err
+	}
+	return stops
+}
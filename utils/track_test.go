@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// drive returns a track point lat steps (0.001 degrees, ~111m) north of the start, min minutes after the start.
+func drive(lat float64, min int) TrackPoint {
+	return TrackPoint{Lat: 50.9 + lat*0.001, Lng: 13.3, Time: time.Unix(1700000000, 0).Add(time.Duration(min) * time.Minute)}
+}
+
+func TestDetectStops(t *testing.T) {
+	// drives 2 steps, stays there for 8 minutes & drives on
+	track := []TrackPoint{drive(0, 0), drive(1, 1), drive(2, 2), drive(2, 4), drive(2, 7), drive(2, 10), drive(3, 11), drive(4, 12)}
+	short := []TrackPoint{drive(0, 0), drive(1, 1), drive(1, 4), drive(2, 5)}
+	unsorted := []TrackPoint{track[5], track[0], track[7], track[2], track[1], track[6], track[4], track[3]}
+
+	tests := []struct {
+		name   string
+		points []TrackPoint
+		opts   StopOptions
+		want   [][2]int // arrival & departure minute of each stop
+	}{
+		{"empty track", nil, StopOptions{}, nil},
+		{"stop & endpoints", track, StopOptions{}, [][2]int{{0, 0}, {2, 10}, {12, 12}}},
+		{"skip endpoints", track, StopOptions{SkipEndpoints: true}, [][2]int{{2, 10}}},
+		{"unsorted points", unsorted, StopOptions{SkipEndpoints: true}, [][2]int{{2, 10}}},
+		{"dwell too short", short, StopOptions{SkipEndpoints: true}, nil},
+		{"shorter min dwell", short, StopOptions{SkipEndpoints: true, MinDwell: 3 * time.Minute}, [][2]int{{1, 4}}},
+		{"bigger max distance", track, StopOptions{SkipEndpoints: true, MaxDistance: 250}, [][2]int{{0, 10}}},
+	}
+	for _, tt := range tests {
+		stops := DetectStops(tt.points, tt.opts)
+		if len(stops) != len(tt.want) {
+			t.Errorf("%s : got %d stops %+v, want %v", tt.name, len(stops), stops, tt.want)
+			continue
+		}
+		for i, s := range stops {
+			if s.Arrival != drive(0, tt.want[i][0]).Time || s.Departure != drive(0, tt.want[i][1]).Time {
+				t.Errorf("%s : stop %d from %v to %v, want minute %d to %d", tt.name, i, s.Arrival, s.Departure, tt.want[i][0], tt.want[i][1])
+			}
+		}
+	}
+}
+
+func TestDetectStopsPosition(t *testing.T) {
+	stops := DetectStops([]TrackPoint{drive(0, 0), drive(0.2, 3), drive(0.4, 6)}, StopOptions{})
+	if len(stops) != 1 {
+		t.Fatalf("got %d stops, want 1", len(stops))
+	}
+	// the stop is at the average position of its points
+	if want := drive(0.2, 0); Distance(stops[0].Lat, stops[0].Lng, want.Lat, want.Lng) > 0.1 {
+		t.Errorf("stop at %f,%f, want %f,%f", stops[0].Lat, stops[0].Lng, want.Lat, want.Lng)
+	}
+}
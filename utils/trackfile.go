@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrTrackNotParsable = errors.New("Track is neither GPX nor GeoJSON")
+var ErrTrackWithoutTimes = errors.New("Track has no timestamps")
+
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lng  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+type geoJsonObject struct {
+	Type       string          `json:"type"`
+	Features   []geoJsonObject `json:"features"`
+	Geometry   *geoJsonObject  `json:"geometry"`
+	Geometries []geoJsonObject `json:"geometries"`
+	// LineString: [[lng, lat, (ele), (time)], ...] - MultiLineString: [[[lng, lat, ...], ...], ...]
+	Coordinates json.RawMessage `json:"coordinates"`
+	Properties  struct {
+		// timestamps per coordinate, as written by e.g. togeojson - nested per line for MultiLineStrings
+		CoordTimes json.RawMessage `json:"coordTimes"`
+		Times      json.RawMessage `json:"times"`
+	} `json:"properties"`
+}
+
+// ParseTrack returns the points of a GPX file (tracks & routes) or a GeoJSON LineString / MultiLineString, as Feature,
+// FeatureCollection or plain geometry. GeoJSON timestamps are taken from the properties coordTimes or times or from
+// the 4th value of the coordinates. Points without a timestamp are left out.
+func ParseTrack(b []byte) (points []TrackPoint, err error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, ErrTrackNotParsable
+	}
+	switch b[0] {
+	case '<':
+		points, err = parseGpx(b)
+	case '{':
+		var o geoJsonObject
+		err = json.Unmarshal(b, &o)
+		if err == nil {
+			points = geoJsonPoints(o, nil)
+		}
+	default:
+		return nil, ErrTrackNotParsable
+	}
+	if err == nil && len(points) == 0 {
+		err = ErrTrackWithoutTimes
+	}
+	return
+}
+
+func parseGpx(b []byte) (points []TrackPoint, err error) {
+	var f gpxFile
+	err = xml.Unmarshal(b, &f)
+	if err != nil {
+		return
+	}
+	add := func(pts []gpxPoint) {
+		for _, p := range pts {
+			t, err := time.Parse(time.RFC3339, p.Time)
+			if err == nil {
+				points = append(points, TrackPoint{Lat: p.Lat, Lng: p.Lng, Time: t})
+			}
+		}
+	}
+	for _, t := range f.Tracks {
+		for _, s := range t.Segments {
+			add(s.Points)
+		}
+	}
+	for _, r := range f.Routes {
+		add(r.Points)
+	}
+	return
+}
+
+// geoJsonPoints returns the points of all LineStrings in o. times are the timestamps of the parent Feature.
+func geoJsonPoints(o geoJsonObject, times json.RawMessage) (points []TrackPoint) {
+	switch o.Type {
+	case "FeatureCollection":
+		for _, f := range o.Features {
+			points = append(points, geoJsonPoints(f, nil)...)
+		}
+	case "Feature":
+		if o.Geometry != nil {
+			times = o.Properties.CoordTimes
+			if len(times) == 0 {
+				times = o.Properties.Times
+			}
+			points = geoJsonPoints(*o.Geometry, times)
+		}
+	case "GeometryCollection":
+		for _, g := range o.Geometries {
+			points = append(points, geoJsonPoints(g, nil)...)
+		}
+	case "LineString":
+		var coords [][]float64
+		var ts []interface{}
+		if json.Unmarshal(o.Coordinates, &coords) == nil {
+			json.Unmarshal(times, &ts)
+			points = lineStringPoints(coords, ts)
+		}
+	case "MultiLineString":
+		var lines [][][]float64
+		var ts [][]interface{}
+		if json.Unmarshal(o.Coordinates, &lines) == nil {
+			json.Unmarshal(times, &ts)
+			for i, coords := range lines {
+				var lineTimes []interface{}
+				if i < len(ts) {
+					lineTimes = ts[i]
+				}
+				points = append(points, lineStringPoints(coords, lineTimes)...)
+			}
+		}
+	}
+	return
+}
+
+func lineStringPoints(coords [][]float64, times []interface{}) (points []TrackPoint) {
+	for i, c := range coords {
+		if len(c) < 2 {
+			continue
+		}
+		var t time.Time
+		if i < len(times) {
+			t = parseGeoJsonTime(times[i])
+		} else if len(c) >= 4 {
+			t = parseGeoJsonTime(c[3])
+		}
+		if !t.IsZero() {
+			points = append(points, TrackPoint{Lat: c[1], Lng: c[0], Time: t})
+		}
+	}
+	return
+}
+
+// parseGeoJsonTime parses a RFC3339 timestamp or unix time in seconds or milliseconds.
+func parseGeoJsonTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case string:
+		if ts, err := time.Parse(time.RFC3339, t); err == nil {
+			return ts
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return parseGeoJsonTime(f)
+		}
+	case float64:
+		if t > 1e11 {
+			return time.Unix(0, int64(t*float64(time.Millisecond)))
+		}
+		return time.Unix(0, int64(t*float64(time.Second)))
+	}
+	return time.Time{}
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pt returns a track point sec seconds after 2016-03-30 12:00 UTC.
+func pt(lat float64, lng float64, sec int) TrackPoint {
+	return TrackPoint{Lat: lat, Lng: lng, Time: time.Date(2016, 3, 30, 12, 0, sec, 0, time.UTC)}
+}
+
+func TestParseTrack(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []TrackPoint
+		err  error // errMalformed for any error of the xml or json decoder
+	}{
+		{"gpx track", `<?xml version="1.0"?><gpx version="1.1"><trk><trkseg>
+			<trkpt lat="50.9" lon="13.3"><time>2016-03-30T12:00:00Z</time></trkpt>
+			<trkpt lat="50.91" lon="13.31"><ele>400</ele><time>2016-03-30T12:00:10Z</time></trkpt>
+			</trkseg></trk></gpx>`,
+			[]TrackPoint{pt(50.9, 13.3, 0), pt(50.91, 13.31, 10)}, nil},
+		{"gpx segments, tracks & routes", `<gpx>
+			<trk><trkseg><trkpt lat="1" lon="2"><time>2016-03-30T12:00:00Z</time></trkpt></trkseg>
+			<trkseg><trkpt lat="3" lon="4"><time>2016-03-30T12:00:01Z</time></trkpt></trkseg></trk>
+			<trk><trkseg><trkpt lat="5" lon="6"><time>2016-03-30T14:00:02+02:00</time></trkpt></trkseg></trk>
+			<rte><rtept lat="7" lon="8"><time>2016-03-30T12:00:03Z</time></rtept></rte></gpx>`,
+			[]TrackPoint{pt(1, 2, 0), pt(3, 4, 1), pt(5, 6, 2), pt(7, 8, 3)}, nil},
+		{"gpx points without time", `<gpx><trk><trkseg>
+			<trkpt lat="1" lon="2"></trkpt>
+			<trkpt lat="3" lon="4"><time>2016-03-30T12:00:05Z</time></trkpt>
+			<trkpt lat="5" lon="6"><time>yesterday</time></trkpt>
+			</trkseg></trk></gpx>`,
+			[]TrackPoint{pt(3, 4, 5)}, nil},
+		{"gpx without times", `<gpx><trk><trkseg><trkpt lat="1" lon="2"/><trkpt lat="3" lon="4"/></trkseg></trk></gpx>`,
+			nil, ErrTrackWithoutTimes},
+		{"gpx without points", `<gpx></gpx>`, nil, ErrTrackWithoutTimes},
+		{"malformed gpx", `<gpx><trk><trkseg><trkpt lat="1" lon="2"><time>2016-03-30T12:00:00Z</time></trkseg></gpx>`,
+			nil, errMalformed},
+		{"gpx with invalid coordinate", `<gpx><trk><trkseg><trkpt lat="north" lon="2"><time>2016-03-30T12:00:00Z</time></trkpt></trkseg></trk></gpx>`,
+			nil, errMalformed},
+
+		{"geojson feature with coordTimes", `{"type":"Feature","properties":{"coordTimes":["2016-03-30T12:00:00Z","2016-03-30T12:00:10Z"]},
+			"geometry":{"type":"LineString","coordinates":[[13.3,50.9],[13.31,50.91]]}}`,
+			[]TrackPoint{pt(50.9, 13.3, 0), pt(50.91, 13.31, 10)}, nil},
+		{"geojson times in seconds & milliseconds", `{"type":"Feature","properties":{"times":[1459339200,"1459339201",1459339202000]},
+			"geometry":{"type":"LineString","coordinates":[[2,1],[4,3],[6,5]]}}`,
+			[]TrackPoint{pt(1, 2, 0), pt(3, 4, 1), pt(5, 6, 2)}, nil},
+		{"geojson time as 4th coordinate", `{"type":"LineString","coordinates":[[2,1,400,1459339200],[4,3],[6,5,400,1459339202]]}`,
+			[]TrackPoint{pt(1, 2, 0), pt(5, 6, 2)}, nil},
+		{"geojson multi line string", `{"type":"Feature","properties":{"coordTimes":[["2016-03-30T12:00:00Z"],["2016-03-30T12:00:01Z","2016-03-30T12:00:02Z"]]},
+			"geometry":{"type":"MultiLineString","coordinates":[[[2,1]],[[4,3],[6,5]]]}}`,
+			[]TrackPoint{pt(1, 2, 0), pt(3, 4, 1), pt(5, 6, 2)}, nil},
+		{"geojson feature collection", `{"type":"FeatureCollection","features":[
+			{"type":"Feature","properties":{"coordTimes":["2016-03-30T12:00:00Z"]},"geometry":{"type":"LineString","coordinates":[[2,1]]}},
+			{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[4,3]}},
+			{"type":"Feature","properties":{},"geometry":null},
+			{"type":"Feature","properties":{"coordTimes":["2016-03-30T12:00:01Z"]},"geometry":{"type":"LineString","coordinates":[[6,5]]}}]}`,
+			[]TrackPoint{pt(1, 2, 0), pt(5, 6, 1)}, nil},
+		{"geojson geometry collection", `{"type":"GeometryCollection","geometries":[{"type":"LineString","coordinates":[[2,1,0,1459339200]]}]}`,
+			[]TrackPoint{pt(1, 2, 0)}, nil},
+		{"geojson short coordinates", `{"type":"LineString","coordinates":[[2],[4,3,0,1459339201]]}`,
+			[]TrackPoint{pt(3, 4, 1)}, nil},
+		{"geojson without times", `{"type":"LineString","coordinates":[[2,1],[4,3]]}`, nil, ErrTrackWithoutTimes},
+		{"geojson point", `{"type":"Point","coordinates":[2,1]}`, nil, ErrTrackWithoutTimes},
+		{"malformed geojson", `{"type":"LineString","coordinates":[[2,1]`, nil, errMalformed},
+
+		{"empty file", ``, nil, ErrTrackNotParsable},
+		{"only whitespace", " \r\n\t", nil, ErrTrackNotParsable},
+		{"csv", "lat,lng,time\n50.9,13.3,1459339200", nil, ErrTrackNotParsable},
+		{"json array", `[{"lat":50.9,"lng":13.3}]`, nil, ErrTrackNotParsable},
+	}
+	for _, tt := range tests {
+		points, err := ParseTrack([]byte(tt.file))
+		if isMalformed(err) {
+			err = errMalformed
+		}
+		if err != tt.err {
+			t.Errorf("%s : err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(points) != len(tt.want) {
+			t.Errorf("%s : got %d points %+v, want %+v", tt.name, len(points), points, tt.want)
+			continue
+		}
+		for i, p := range points {
+			if p.Lat != tt.want[i].Lat || p.Lng != tt.want[i].Lng || !p.Time.Equal(tt.want[i].Time) {
+				t.Errorf("%s : point %d = %+v, want %+v", tt.name, i, p, tt.want[i])
+			}
+		}
+	}
+}
+
+// errMalformed stands for any error of the xml or json decoder in TestParseTrack.
+var errMalformed = errors.New("malformed")
+
+func isMalformed(err error) bool {
+	switch err.(type) {
+	case *xml.SyntaxError, *json.SyntaxError, *json.UnmarshalTypeError, *strconv.NumError:
+		return true
+	}
+	return false
+}